@@ -0,0 +1,422 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"sync"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+	"github.com/ron96G/clamav-facade/clamav"
+)
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobDone      JobState = "done"
+	JobCancelled JobState = "cancelled"
+	// JobTimedOut is the state of jobs which exceeded the JobTimeout
+	JobTimedOut JobState = "timed_out"
+)
+
+// Job is an asynchronous scan. The results are available once the job is done.
+type Job struct {
+	ID       string     `json:"id"`
+	State    JobState   `json:"state"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Code is the status code the scan would have returned synchronously
+	Code int `json:"code,omitempty"`
+	*Response
+
+	items    []jobItem
+	expand   bool
+	callback string
+	cancel   context.CancelFunc
+	ctx      context.Context
+}
+
+// jobItem is either an uploaded file which has been spooled to disk or an url
+type jobItem struct {
+	id       string
+	filename string
+	path     string
+	url      string
+}
+
+type jobQueue struct {
+	mu    sync.Mutex
+	once  sync.Once
+	jobs  map[string]*Job
+	queue chan *Job
+	// stopped is set once the API is stopped, no more jobs are queued afterwards
+	stopped bool
+}
+
+// SubmitJob accepts the files of the request and scans them asynchronously.
+// Multipart uploads, raw uploads and json lists of urls are supported.
+// Uploaded files are stored on disk until the job is finished.
+func (a *API) SubmitJob(e echo.Context) error {
+	resp := newResponse()
+	a.startJobs()
+
+	if err := a.setCallback(e, e.QueryParam("callback_url")); err != nil {
+		return a.invalidCallback(e, err)
+	}
+
+	items, err := a.readJobItems(e)
+	if err != nil {
+		removeJobItems(items)
+		code, errCode, details := 400, ErrCodeInvalidRequest, err.Error()
+		if errors.Is(err, clamav.ErrFileTooLarge) {
+			errCode, details = ErrCodeSizeLimitExceeded, "file size limit exceeded"
+		}
+		a.Log.Warn("Rejected job", "error", err)
+		resp.Results = append(resp.Results, Result{Status: "failed", Code: code, Error: errCode, Details: details})
+		return returnJSON(e, code, resp)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:       newJobID(),
+		State:    JobQueued,
+		Created:  time.Now(),
+		items:    items,
+		expand:   expandArchives(e),
+		callback: callbackURL(e),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	a.jobs.mu.Lock()
+	queued, details := false, "job queue is full"
+	if a.jobs.stopped {
+		details = "api is shutting down"
+	} else {
+		select {
+		case a.jobs.queue <- job:
+			a.jobs.jobs[job.ID] = job
+			queued = true
+		default:
+		}
+	}
+	a.jobs.mu.Unlock()
+	if !queued {
+		cancel()
+		removeJobItems(items)
+		a.Log.Warn("Rejected job", "reason", details)
+		resp.Results = append(resp.Results, Result{Status: "failed", Code: 503, Error: ErrCodeQueueFull, Details: details})
+		return returnJSON(e, 503, resp)
+	}
+
+	a.Log.Info("Submitted job", "id", job.ID, "items", len(items))
+	e.Response().Header().Set("Location", a.Prefix+"/jobs/"+job.ID)
+	return returnJSON(e, 202, a.jobs.snapshot(job))
+}
+
+func (a *API) GetJob(e echo.Context) error {
+	job, ok := a.jobs.get(e.Param("id"))
+	if !ok {
+		return jobNotFound(e)
+	}
+	return returnJSON(e, 200, a.jobs.snapshot(job))
+}
+
+// CancelJob cancels the context of the job. Files which have been scanned already stay part of the results.
+func (a *API) CancelJob(e echo.Context) error {
+	job, ok := a.jobs.get(e.Param("id"))
+	if !ok {
+		return jobNotFound(e)
+	}
+
+	a.jobs.mu.Lock()
+	if job.State == JobQueued {
+		// the worker skips cancelled jobs
+		now := time.Now()
+		job.State = JobCancelled
+		job.Finished = &now
+	}
+	a.jobs.mu.Unlock()
+	job.cancel()
+
+	a.Log.Info("Cancelled job", "id", job.ID)
+	return returnJSON(e, 200, a.jobs.snapshot(job))
+}
+
+func jobNotFound(e echo.Context) error {
+	resp := newResponse()
+	resp.Results = append(resp.Results, Result{Status: "failed", Code: 404, Error: ErrCodeNotFound, Details: "job not found"})
+	return returnJSON(e, 404, resp)
+}
+
+func (a *API) readJobItems(e echo.Context) (items []jobItem, err error) {
+	req := e.Request()
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "multipart/form-data":
+		reader, err := req.MultipartReader()
+		if err != nil {
+			return nil, err
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return items, err
+			}
+			if part.FileName() == "" && part.FormName() == "callback_url" {
+				err := a.readCallback(e, part)
+				part.Close()
+				if err != nil {
+					return items, err
+				}
+				continue
+			}
+			if part.FileName() == "" {
+				part.Close()
+				continue
+			}
+			path, err := a.spool(part)
+			part.Close()
+			if err != nil {
+				return items, err
+			}
+			items = append(items, jobItem{id: part.FormName(), filename: part.FileName(), path: path})
+		}
+
+	case "application/octet-stream":
+		if req.ContentLength > 0 && !a.client.CheckFilesize(int(req.ContentLength)) {
+			return nil, clamav.ErrFileTooLarge
+		}
+		path, err := a.spool(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, jobItem{filename: req.Header.Get("X-Filename"), path: path})
+
+	case "application/json":
+		body := ScanURLRequest{}
+		if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil {
+			return nil, err
+		}
+		if err := a.setCallback(e, body.CallbackURL); err != nil {
+			return nil, err
+		}
+		for _, rawURL := range body.URLs {
+			items = append(items, jobItem{id: rawURL, url: rawURL})
+		}
+
+	default:
+		return nil, errors.New("request Content-Type must be multipart/form-data, application/octet-stream or application/json")
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("request does not contain any files")
+	}
+	return items, nil
+}
+
+// spool stores r in a temporary file. The size limit is enforced while writing.
+func (a *API) spool(r io.Reader) (path string, err error) {
+	file, err := os.CreateTemp("", "clamav-facade-job-*")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(file, clamav.LimitReader(r, a.client.MaxFilesize())); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func removeJobItems(items []jobItem) {
+	for _, item := range items {
+		if item.path != "" {
+			os.Remove(item.path)
+		}
+	}
+}
+
+// startJobs starts the workers and the cleanup of finished jobs once
+func (a *API) startJobs() {
+	a.jobs.once.Do(func() {
+		workers := a.JobWorkers
+		if workers < 1 {
+			workers = 1
+		}
+		a.jobs.queue = make(chan *Job, a.JobQueueSize)
+		for i := 0; i < workers; i++ {
+			go a.jobWorker()
+		}
+		go a.cleanupJobs()
+	})
+}
+
+func (a *API) jobWorker() {
+	for {
+		select {
+		case <-a.StopChan:
+			return
+		case job := <-a.jobs.queue:
+			a.runJob(job)
+		}
+	}
+}
+
+func (a *API) runJob(job *Job) {
+	defer removeJobItems(job.items)
+
+	a.jobs.mu.Lock()
+	if job.State == JobCancelled {
+		a.jobs.mu.Unlock()
+		return
+	}
+	started := time.Now()
+	job.State = JobRunning
+	job.Started = &started
+	a.jobs.mu.Unlock()
+
+	ctx := job.ctx
+	if a.JobTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.JobTimeout)
+		defer cancel()
+	}
+
+	resp := newResponse()
+	for _, item := range job.items {
+		if ctx.Err() != nil {
+			break
+		}
+		results := a.scanJobItem(ctx, item, job.expand)
+		resp.Results = append(resp.Results, results...)
+		if a.stopBatch(results) {
+			break
+		}
+	}
+	resp.summarize()
+
+	a.jobs.mu.Lock()
+	finished := time.Now()
+	job.Response = resp
+	job.Code = batchStatus(resp.Results)
+	job.Finished = &finished
+	switch {
+	case job.ctx.Err() != nil:
+		job.State = JobCancelled
+	case ctx.Err() != nil:
+		job.State = JobTimedOut
+	default:
+		job.State = JobDone
+	}
+	a.jobs.mu.Unlock()
+	job.cancel()
+	a.notify(job.callback, resp, a.jobs.snapshot(job))
+
+	a.Log.Info("Finished job", "id", job.ID, "state", job.State, "elapsed_time", finished.Sub(started).Milliseconds())
+}
+
+func (a *API) scanJobItem(ctx context.Context, item jobItem, expand bool) []Result {
+	if item.url != "" {
+		return a.scanURL(ctx, item.url, expand)
+	}
+	file, err := os.Open(item.path)
+	if err != nil {
+		return []Result{{ID: item.id, Filename: item.filename, Status: "failed", Code: 500, Error: ErrCodeInternal, Details: err.Error()}}
+	}
+	defer file.Close()
+	return a.scanFile(ctx, item.id, item.filename, file, expand)
+}
+
+// cleanupJobs removes finished jobs after JobTTL. Once the API is stopped, all jobs are cancelled
+// and the files of the queued jobs are removed.
+func (a *API) cleanupJobs() {
+	interval := a.JobTTL / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.StopChan:
+			a.jobs.mu.Lock()
+			a.jobs.stopped = true
+			for _, job := range a.jobs.jobs {
+				job.cancel()
+			}
+			a.jobs.mu.Unlock()
+			a.drainJobs()
+			return
+
+		case <-ticker.C:
+			a.jobs.mu.Lock()
+			for id, job := range a.jobs.jobs {
+				if job.Finished != nil && time.Since(*job.Finished) > a.JobTTL {
+					delete(a.jobs.jobs, id)
+				}
+			}
+			a.jobs.mu.Unlock()
+		}
+	}
+}
+
+// drainJobs cancels the jobs which are still queued since the workers are stopped as well
+func (a *API) drainJobs() {
+	for {
+		select {
+		case job := <-a.jobs.queue:
+			a.jobs.mu.Lock()
+			now := time.Now()
+			job.State = JobCancelled
+			job.Finished = &now
+			a.jobs.mu.Unlock()
+			removeJobItems(job.items)
+		default:
+			return
+		}
+	}
+}
+
+func (q *jobQueue) get(id string) (*Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	return job, ok
+}
+
+// snapshot returns a copy of job which can be serialized while the job is running
+func (q *jobQueue) snapshot(job *Job) Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return Job{
+		ID:       job.ID,
+		State:    job.State,
+		Created:  job.Created,
+		Started:  job.Started,
+		Finished: job.Finished,
+		Code:     job.Code,
+		Response: job.Response,
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
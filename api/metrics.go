@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/ron96G/clamav-facade/clamav"
+)
+
+var (
+	clamdUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clamav_facade",
+		Subsystem: "clamd",
+		Name:      "up",
+		Help:      "Whether the last stats of clamd could be retrieved",
+	}, []string{"backend"})
+	clamdPools = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clamav_facade",
+		Subsystem: "clamd",
+		Name:      "pools",
+		Help:      "Number of memory pools of clamd",
+	}, []string{"backend"})
+	clamdThreads = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clamav_facade",
+		Subsystem: "clamd",
+		Name:      "threads",
+		Help:      "Number of threads of clamd by state (live, idle, max)",
+	}, []string{"backend", "state"})
+	clamdQueue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clamav_facade",
+		Subsystem: "clamd",
+		Name:      "queue_items",
+		Help:      "Number of items in the queue of clamd",
+	}, []string{"backend"})
+	clamdMemory = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clamav_facade",
+		Subsystem: "clamd",
+		Name:      "memory_megabytes",
+		Help:      "Memory usage of clamd in megabytes by type",
+	}, []string{"backend", "type"})
+)
+
+// pollStats periodically exports the stats of clamd as metrics until the API is stopped
+func (a *API) pollStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		a.collectStats(interval)
+		select {
+		case <-a.StopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *API) collectStats(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for name, backend := range a.statsBackends() {
+		wg.Add(1)
+		go func(name string, backend statsClient) {
+			defer wg.Done()
+			stats, err := backend.Stats(ctx)
+			if err != nil {
+				a.Log.Warn("Failed to collect stats of clamav", "backend", name, "error", err)
+				clamdUp.WithLabelValues(name).Set(0)
+				return
+			}
+			clamdUp.WithLabelValues(name).Set(1)
+			setStatsMetrics(name, stats)
+		}(name, backend)
+	}
+	wg.Wait()
+}
+
+type statsClient interface {
+	Stats(ctx context.Context) (*clamav.Stats, error)
+}
+
+// statsBackends returns the clamd instances of the client by their address.
+// The stats of a group are collected per backend, the group itself only returns the stats of one of them.
+func (a *API) statsBackends() map[string]statsClient {
+	backends := map[string]statsClient{}
+	switch c := a.client.(type) {
+	case interface{ Backends() []*clamav.ClamavClient }:
+		for _, b := range c.Backends() {
+			backends[b.Addr()] = b
+		}
+	case interface{ Addr() string }:
+		backends[c.Addr()] = a.client
+	default:
+		backends[""] = a.client
+	}
+	return backends
+}
+
+func setStatsMetrics(backend string, stats *clamav.Stats) {
+	clamdPools.WithLabelValues(backend).Set(float64(stats.Pools))
+	clamdQueue.WithLabelValues(backend).Set(float64(stats.Queue))
+	clamdThreads.WithLabelValues(backend, "live").Set(float64(stats.Threads.Live))
+	clamdThreads.WithLabelValues(backend, "idle").Set(float64(stats.Threads.Idle))
+	clamdThreads.WithLabelValues(backend, "max").Set(float64(stats.Threads.Max))
+
+	mem := map[string]*float64{
+		"heap":        stats.Memory.Heap,
+		"mmap":        stats.Memory.Mmap,
+		"used":        stats.Memory.Used,
+		"free":        stats.Memory.Free,
+		"releasable":  stats.Memory.Releasable,
+		"pools_used":  stats.Memory.PoolsUsed,
+		"pools_total": stats.Memory.PoolsTotal,
+	}
+	for name, value := range mem {
+		if value == nil {
+			clamdMemory.DeleteLabelValues(backend, name)
+			continue
+		}
+		clamdMemory.WithLabelValues(backend, name).Set(*value)
+	}
+}
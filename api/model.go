@@ -9,18 +9,55 @@ import (
 	"time"
 
 	echo "github.com/labstack/echo/v4"
+	"github.com/ron96G/clamav-facade/archive"
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/clamav-facade/fetch"
+	"github.com/ron96G/clamav-facade/webhook"
 	log "github.com/ron96G/go-common-utils/log"
 )
 
+type BatchPolicy string
+
+const (
+	// FailFast stops scanning the remaining files of a request once a file failed.
+	// The remaining files are not part of the response.
+	FailFast BatchPolicy = "fail-fast"
+	// Continue scans all files of a request and reports each failure separately
+	Continue BatchPolicy = "continue"
+)
+
+func ParseBatchPolicy(s string) (BatchPolicy, error) {
+	switch BatchPolicy(s) {
+	case FailFast, Continue:
+		return BatchPolicy(s), nil
+	}
+	return "", fmt.Errorf("unknown batch policy %q", s)
+}
+
+// Error codes of failed results
+const (
+	ErrCodeInvalidRequest    = "invalid_request"
+	ErrCodeSizeLimitExceeded = "size_limit_exceeded"
+	ErrCodeClamavUnavailable = "clamav_unavailable"
+	ErrCodeClamavError       = "clamav_error"
+	ErrCodeURLForbidden      = "url_forbidden"
+	ErrCodeFetchFailed       = "fetch_failed"
+	ErrCodeQueueFull         = "queue_full"
+	ErrCodeNotFound          = "not_found"
+	ErrCodeInternal          = "internal_error"
+	ErrCodeArchiveLimit      = "archive_limit_exceeded"
+)
+
 type Client interface {
-	Scan(context.Context, io.Reader) (bool, error)
-	ScanFile(context.Context, string) (bool, error)
-	Stats(ctx context.Context) (string, error)
+	Scan(context.Context, io.Reader) (*clamav.ScanResult, error)
+	ScanFile(context.Context, string) (*clamav.ScanResult, error)
+	Stats(ctx context.Context) (*clamav.Stats, error)
 	Reload(ctx context.Context) error
-	Version(ctx context.Context) (string, error)
+	Version(ctx context.Context) (*clamav.VersionInfo, error)
 	Ping(ctx context.Context) error
 	Shutdown(ctx context.Context)
 	CheckFilesize(int) bool
+	MaxFilesize() int
 }
 
 type API struct {
@@ -35,6 +72,37 @@ type API struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	IdleTimeout  time.Duration
+	// StatsInterval is the interval in which the stats of clamav are exported as metrics.
+	// A value of 0 disables the export.
+	StatsInterval time.Duration
+	// MaxDatabaseAge is the maximum age of the signature database until the API is no longer ready.
+	// A value of 0 disables the check.
+	MaxDatabaseAge time.Duration
+	// MaxQueueLength is the maximum length of the queue of clamav until the API is no longer ready.
+	// A value of 0 disables the check.
+	MaxQueueLength int
+	// BatchPolicy decides whether the remaining files of a request are scanned once a file failed
+	BatchPolicy BatchPolicy
+	// Fetchers provides the files of ScanURL. It must not be able to read local files.
+	Fetchers *fetch.Registry
+	// ArchiveLimits stop the expansion of archives which would exhaust the resources
+	ArchiveLimits archive.Limits
+	// Webhooks delivers the responses to callback urls. If it is nil, callbacks are disabled.
+	Webhooks *webhook.Sender
+	// InfectionWebhook receives every response which contains a virus
+	InfectionWebhook string
+	// InfectionSender delivers to the InfectionWebhook. Unlike Webhooks it does not need to restrict
+	// the destinations, since the url is configured by the operator. If it is nil, Webhooks is used.
+	InfectionSender *webhook.Sender
+	// JobWorkers is the number of jobs which are scanned concurrently
+	JobWorkers int
+	// JobQueueSize is the number of jobs which can wait for a worker. Further jobs are rejected.
+	JobQueueSize int
+	// JobTTL is the duration for which finished jobs are kept
+	JobTTL time.Duration
+	// JobTimeout is the maximum duration of a job. A value of 0 disables the timeout.
+	JobTimeout time.Duration
+	jobs       jobQueue
 }
 
 func (a *API) ToString() string {
@@ -45,12 +113,61 @@ func (a *API) ToString() string {
 }
 
 type Result struct {
-	ID      string      `json:"id,omitempty"`
-	Status  string      `json:"status,omitempty"`
-	Details interface{} `json:"details,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	// Path is the path of the entry if an archive is expanded
+	Path string `json:"path,omitempty"`
+	// ContentType is the media type of a part of an email
+	ContentType string `json:"content_type,omitempty"`
+	// Size is the number of bytes which have been scanned
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Elapsed is the duration of the scan in milliseconds
+	Elapsed int64 `json:"elapsed_ms,omitempty"`
+	// Code is the status code of this result
+	Code int `json:"code,omitempty"`
+	// Error is one of the ErrCode constants if the result failed
+	Error   string              `json:"error,omitempty"`
+	Details interface{}         `json:"details,omitempty"`
+	Version *clamav.VersionInfo `json:"version,omitempty"`
+	// err is the error of the client which caused the failure
+	err error
 }
+
+// ScanURLRequest is the body of ScanURL
+type ScanURLRequest struct {
+	URLs []string `json:"urls"`
+	// CallbackURL receives the response once the scan is finished
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// Summary counts the results of a scan by their outcome
+type Summary struct {
+	Total    int `json:"total"`
+	Clean    int `json:"clean"`
+	Infected int `json:"infected"`
+	Failed   int `json:"failed"`
+}
+
 type Response struct {
 	Results []Result `json:"results,omitempty"`
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// summarize sets the summary of all results
+func (r *Response) summarize() {
+	r.Summary = &Summary{Total: len(r.Results)}
+	for _, result := range r.Results {
+		switch result.Status {
+		case "success":
+			r.Summary.Clean++
+		case "virus":
+			r.Summary.Infected++
+		default:
+			r.Summary.Failed++
+		}
+	}
 }
 
 func newResponse() *Response {
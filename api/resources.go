@@ -1,70 +1,356 @@
 package api
 
 import (
-	"mime/multipart"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	echo "github.com/labstack/echo/v4"
+	"github.com/ron96G/clamav-facade/archive"
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/clamav-facade/email"
+	"github.com/ron96G/clamav-facade/fetch"
 )
 
+// Scan streams each file of the multipart request to clamav as it arrives.
+// The size limit is enforced while streaming. Every file is reported as a separate result
+// in the order of the request. Whether a failed file stops the batch depends on the BatchPolicy.
+// With expand=true, each entry of an archive is reported as a separate result.
 func (a *API) Scan(e echo.Context) error {
 	req := e.Request()
 	resp := newResponse()
-	var err error
-	statusCode := 200
 
+	expand := expandArchives(e)
 	a.Log.Debug("Content-Type", "value", req.Header.Get("Content-Type"))
+	if err := a.setCallback(e, e.QueryParam("callback_url")); err != nil {
+		return a.invalidCallback(e, err)
+	}
 
-	// limit the maximum memory when parsing request to 16MB
-	if err = req.ParseMultipartForm(32 << 19); err != nil {
-		a.Log.Warn("Unable to parse multipartform", "error", err)
+	reader, err := req.MultipartReader()
+	if err != nil {
+		a.Log.Warn("Unable to read multipartform", "error", err)
 		resp.Results = append(resp.Results, Result{Status: "failed", Details: err.Error()})
 		return returnJSON(e, 400, resp)
 	}
 
-	var file multipart.File
-	var ok bool
-	for key, headers := range req.MultipartForm.File {
-
-		file, _, err = req.FormFile(key)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			resp.Results = append(resp.Results, Result{ID: key, Status: "failed", Details: err.Error()})
-			return returnJSON(e, 400, resp)
+			// the request body is broken, the remaining files can not be read
+			a.Log.Warn("Unable to read multipartform", "error", err)
+			resp.Results = append(resp.Results, Result{Status: "failed", Code: 400, Error: ErrCodeInvalidRequest, Details: err.Error()})
+			break
+		}
+		if part.FileName() == "" && part.FormName() == "callback_url" {
+			err := a.readCallback(e, part)
+			part.Close()
+			if err != nil {
+				resp.Results = append(resp.Results, Result{Status: "failed", Code: 400, Error: ErrCodeInvalidRequest, Details: "invalid callback_url: " + err.Error()})
+				break
+			}
+			continue
+		}
+		if part.FileName() == "" {
+			// not a file
+			part.Close()
+			continue
 		}
-		defer file.Close()
 
-		if !a.client.CheckFilesize(int(headers[0].Size)) {
-			a.Log.Warn("Rejected file due to length", "filename", key, "length", float64(headers[0].Size)/1024/1024)
-			resp.Results = append(resp.Results, Result{ID: key, Status: "failed", Details: "file size limit exceeded"})
-			statusCode = 400
+		results := a.scanFile(req.Context(), part.FormName(), part.FileName(), part, expand)
+		part.Close()
+		resp.Results = append(resp.Results, results...)
+		if a.stopBatch(results) {
 			break
 		}
-		start := time.Now()
-		ok, err = a.client.Scan(req.Context(), file)
+	}
+
+	return a.returnResults(e, resp)
+}
+
+// ScanRaw streams the body of an application/octet-stream request to clamav.
+// The declared length is checked before the body is read and the size limit is enforced while streaming.
+func (a *API) ScanRaw(e echo.Context) error {
+	req := e.Request()
+	resp := newResponse()
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/octet-stream" {
+		resp.Results = append(resp.Results, Result{Status: "failed", Code: 400, Error: ErrCodeInvalidRequest, Details: "request Content-Type isn't application/octet-stream"})
+		return returnJSON(e, 400, resp)
+	}
+
+	if err := a.setCallback(e, e.QueryParam("callback_url")); err != nil {
+		return a.invalidCallback(e, err)
+	}
+
+	filename := req.Header.Get("X-Filename")
+	if req.ContentLength > 0 && !a.client.CheckFilesize(int(req.ContentLength)) {
+		a.Log.Warn("Rejected file due to length", "filename", filename, "length", req.ContentLength)
+		resp.Results = append(resp.Results, Result{Filename: filename, Status: "failed", Code: 400, Error: ErrCodeSizeLimitExceeded, Details: "file size limit exceeded"})
+		return returnJSON(e, 400, resp)
+	}
+
+	resp.Results = append(resp.Results, a.scanFile(req.Context(), "", filename, req.Body, expandArchives(e))...)
+
+	return a.returnResults(e, resp)
+}
+
+// ScanEmail parses the RFC 5322 message of the request and scans each part separately.
+// Multipart bodies and nested messages are descended and transfer encodings are removed.
+// Every part is reported as a result with its path in the message, e.g. '2.1'.
+// With expand=true, attached archives are expanded like in Scan.
+func (a *API) ScanEmail(e echo.Context) error {
+	req := e.Request()
+	resp := newResponse()
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "message/rfc822" && mediaType != "application/octet-stream" {
+		resp.Results = append(resp.Results, Result{Status: "failed", Code: 400, Error: ErrCodeInvalidRequest, Details: "request Content-Type isn't message/rfc822 or application/octet-stream"})
+		return returnJSON(e, 400, resp)
+	}
+
+	if err := a.setCallback(e, e.QueryParam("callback_url")); err != nil {
+		return a.invalidCallback(e, err)
+	}
+
+	expand := expandArchives(e)
+	err = email.Walk(req.Body, func(part *email.Part) error {
+		results := a.scanFile(req.Context(), part.Path, part.Filename, part.Body, expand)
+		for i := range results {
+			results[i].ContentType = part.ContentType
+		}
+		resp.Results = append(resp.Results, results...)
+		if a.stopBatch(results) {
+			return errStopBatch
+		}
+		return nil
+	})
+	if err != nil && err != errStopBatch {
+		// the message is broken, the remaining parts can not be read
+		a.Log.Warn("Unable to parse email", "error", err)
+		resp.Results = append(resp.Results, Result{Status: "failed", Code: 400, Error: ErrCodeInvalidRequest, Details: err.Error()})
+	}
+
+	return a.returnResults(e, resp)
+}
+
+// ScanURL downloads each url of the request and streams it to clamav.
+// Downloads are restricted by the Fetchers and aborted once they exceed the size limit.
+// With expand=true, each entry of an archive is reported as a separate result.
+func (a *API) ScanURL(e echo.Context) error {
+	req := e.Request()
+	resp := newResponse()
+
+	body := ScanURLRequest{}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil || len(body.URLs) == 0 {
+		details := "request must contain a list of urls"
 		if err != nil {
-			a.Log.Error("Failed to scan file", "filename", key, "error", err)
-			resp.Results = append(resp.Results, Result{ID: key, Status: "failed", Details: err.Error()})
-			statusCode = 502
+			details = err.Error()
+		}
+		resp.Results = append(resp.Results, Result{Status: "failed", Code: 400, Error: ErrCodeInvalidRequest, Details: details})
+		return returnJSON(e, 400, resp)
+	}
+	if body.CallbackURL == "" {
+		body.CallbackURL = e.QueryParam("callback_url")
+	}
+	if err := a.setCallback(e, body.CallbackURL); err != nil {
+		return a.invalidCallback(e, err)
+	}
+
+	expand := expandArchives(e)
+	for _, rawURL := range body.URLs {
+		results := a.scanURL(req.Context(), rawURL, expand)
+		resp.Results = append(resp.Results, results...)
+		if a.stopBatch(results) {
 			break
+		}
+	}
 
-		} else {
-			a.Log.Info("Scanned file",
-				"filename", key,
-				"length", float64(headers[0].Size)/1024/1024,
-				"elapsed_time", time.Since(start).Milliseconds(),
-				"result", ok,
-			)
-			if !ok {
-				resp.Results = append(resp.Results, Result{ID: key, Status: "virus", Details: "file contains a virus"})
-				statusCode = 200
-
-			} else {
-				resp.Results = append(resp.Results, Result{ID: key, Status: "success", Details: "file does not contains a virus"})
-			}
+	return a.returnResults(e, resp)
+}
+
+func (a *API) scanURL(ctx context.Context, rawURL string, expand bool) []Result {
+	failed := func(code int, errCode string, err error) []Result {
+		return []Result{{ID: rawURL, Status: "failed", Code: code, Error: errCode, Details: err.Error()}}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return failed(400, ErrCodeInvalidRequest, err)
+	}
+	obj, err := a.Fetchers.Fetch(ctx, rawURL)
+	switch {
+	case errors.Is(err, fetch.ErrUnsupportedScheme):
+		return failed(400, ErrCodeInvalidRequest, err)
+	case errors.Is(err, fetch.ErrForbidden):
+		a.Log.Warn("Rejected url", "url", u.Redacted(), "error", err)
+		return failed(403, ErrCodeURLForbidden, err)
+	case err != nil:
+		a.Log.Warn("Failed to fetch url", "url", u.Redacted(), "error", err)
+		return failed(502, ErrCodeFetchFailed, err)
+	}
+	defer obj.Body.Close()
+
+	if obj.Size > 0 && !a.client.CheckFilesize(int(obj.Size)) {
+		a.Log.Warn("Rejected file due to length", "url", u.Redacted(), "length", obj.Size)
+		return []Result{{ID: rawURL, Filename: obj.Name, Status: "failed", Code: 400, Error: ErrCodeSizeLimitExceeded, Details: "file size limit exceeded"}}
+	}
+	return a.scanFile(ctx, rawURL, obj.Name, obj.Body, expand)
+}
+
+// errStopBatch stops the walk of an email or an archive according to the BatchPolicy
+var errStopBatch = errors.New("batch stopped")
+
+// stopBatch returns whether the remaining files are skipped since one of the results failed
+func (a *API) stopBatch(results []Result) bool {
+	if a.BatchPolicy == Continue {
+		return false
+	}
+	for _, result := range results {
+		if result.Status == "failed" {
+			return true
 		}
 	}
+	return false
+}
 
-	return returnJSON(e, statusCode, resp)
+// expandArchives returns whether the archives of the request are expanded
+func expandArchives(e echo.Context) bool {
+	expand, _ := strconv.ParseBool(e.QueryParam("expand"))
+	return expand
+}
+
+// scanFile scans r as a single result. If expand is set and r is an archive,
+// each entry is scanned as a separate result.
+func (a *API) scanFile(ctx context.Context, id, filename string, r io.Reader, expand bool) []Result {
+	if !expand {
+		return []Result{a.scanReader(ctx, id, filename, r)}
+	}
+
+	results := []Result{}
+	err := archive.Walk(clamav.LimitReader(r, a.client.MaxFilesize()), a.ArchiveLimits, func(entry *archive.Entry) error {
+		result := a.scanReader(ctx, id, filename, entry.Body)
+		if errors.Is(result.err, archive.ErrLimitExceeded) {
+			return result.err
+		}
+		result.Path = entry.Path
+		results = append(results, result)
+		if a.stopBatch(results) {
+			return errStopBatch
+		}
+		return nil
+	})
+
+	failed := Result{ID: id, Filename: filename, Status: "failed", Code: 400}
+	switch {
+	case err == nil, err == errStopBatch:
+		return results
+	case errors.Is(err, archive.ErrLimitExceeded):
+		a.Log.Warn("Rejected archive", "filename", filename, "error", err)
+		failed.Error, failed.Details = ErrCodeArchiveLimit, err.Error()
+	case errors.Is(err, clamav.ErrFileTooLarge):
+		a.Log.Warn("Rejected file due to length", "filename", filename)
+		failed.Error, failed.Details = ErrCodeSizeLimitExceeded, "file size limit exceeded"
+	default:
+		a.Log.Warn("Failed to expand archive", "filename", filename, "error", err)
+		failed.Error, failed.Details = ErrCodeInvalidRequest, err.Error()
+	}
+	return append(results, failed)
+}
+
+// scanReader scans a single file and reports it as a result
+func (a *API) scanReader(ctx context.Context, id, filename string, r io.Reader) Result {
+	result := Result{ID: id, Filename: filename}
+
+	hash := sha256.New()
+	start := time.Now()
+	res, err := a.client.Scan(ctx, io.TeeReader(clamav.LimitReader(r, a.client.MaxFilesize()), hash))
+	result.Elapsed = time.Since(start).Milliseconds()
+
+	if errors.Is(err, clamav.ErrFileTooLarge) {
+		a.Log.Warn("Rejected file due to length", "filename", result.Filename)
+		result.Status = "failed"
+		result.Code = 400
+		result.Error = ErrCodeSizeLimitExceeded
+		result.Details = "file size limit exceeded"
+		return result
+	}
+	if err != nil {
+		a.Log.Error("Failed to scan file", "filename", result.Filename, "error", err)
+		result.Status = "failed"
+		result.Code = errorStatus(err)
+		switch result.Code {
+		case http.StatusBadRequest:
+			result.Error = ErrCodeInvalidRequest
+		case http.StatusServiceUnavailable:
+			result.Error = ErrCodeClamavUnavailable
+		default:
+			result.Error = ErrCodeClamavError
+		}
+		result.Details = err.Error()
+		result.err = err
+		return result
+	}
+
+	result.Code = 200
+	result.Size = res.Size
+	result.Version = res.Version
+	result.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	a.Log.Info("Scanned file",
+		"filename", result.Filename,
+		"length", float64(res.Size)/1024/1024,
+		"elapsed_time", result.Elapsed,
+		"result", res.Verdict,
+		"signatures", res.Signatures,
+	)
+	switch res.Verdict {
+	case clamav.VerdictInfected:
+		result.Status = "virus"
+		result.Details = fmt.Sprintf("file contains a virus: %s", res.Signature())
+	default:
+		result.Status = "success"
+		result.Details = "file does not contains a virus"
+	}
+	return result
+}
+
+// returnResults returns the summarized results with the status code of all results
+func (a *API) returnResults(e echo.Context, resp *Response) error {
+	for _, result := range resp.Results {
+		if result.err != nil {
+			setRetryAfter(e, result.err)
+		}
+	}
+	resp.summarize()
+	a.notify(callbackURL(e), resp, resp)
+
+	return returnJSON(e, batchStatus(resp.Results), resp)
+}
+
+// batchStatus returns the status code of a request with multiple results.
+// If the results have different status codes, 207 Multi-Status is returned.
+func batchStatus(results []Result) int {
+	if len(results) == 0 {
+		return 200
+	}
+	for _, result := range results[1:] {
+		if result.Code != results[0].Code {
+			return http.StatusMultiStatus
+		}
+	}
+	return results[0].Code
 }
 
 func (a *API) Ping(e echo.Context) (err error) {
@@ -75,7 +361,7 @@ func (a *API) Ping(e echo.Context) (err error) {
 	if err != nil {
 		a.Log.Error("Failed to ping clamav", "error", err)
 		resp.Results = append(resp.Results, Result{Status: "failed", Details: err.Error()})
-		statusCode = 502
+		statusCode = clientErrorStatus(e, err)
 
 	} else {
 		resp.Results = append(resp.Results, Result{Status: "success", Details: "clamav is ready"})
@@ -83,6 +369,68 @@ func (a *API) Ping(e echo.Context) (err error) {
 	return returnJSON(e, statusCode, resp)
 }
 
+// Live reports whether the API itself is running. It does not depend on clamav.
+func (a *API) Live(e echo.Context) error {
+	resp := newResponse()
+	resp.Results = append(resp.Results, Result{Status: "success", Details: "api is alive"})
+	return returnJSON(e, 200, resp)
+}
+
+// Ready reports whether clamav is reachable, its signature database is up to date
+// and its queue is not exceeding the limit. Each check is reported as a separate result.
+func (a *API) Ready(e echo.Context) error {
+	ctx := e.Request().Context()
+	resp := newResponse()
+	statusCode := 200
+
+	check := func(id string, fn func() (string, error)) {
+		details, err := fn()
+		if err != nil {
+			a.Log.Warn("Readiness check failed", "check", id, "error", err)
+			resp.Results = append(resp.Results, Result{ID: id, Status: "failed", Details: err.Error()})
+			statusCode = 503
+			return
+		}
+		resp.Results = append(resp.Results, Result{ID: id, Status: "success", Details: details})
+	}
+
+	check("clamav", func() (string, error) {
+		return "clamav is ready", a.client.Ping(ctx)
+	})
+
+	if a.MaxDatabaseAge > 0 {
+		check("database", func() (string, error) {
+			version, err := a.client.Version(ctx)
+			if err != nil {
+				return "", err
+			}
+			if version.DatabaseTime.IsZero() {
+				return "", fmt.Errorf("no signature database loaded")
+			}
+			age := time.Since(version.DatabaseTime)
+			if age > a.MaxDatabaseAge {
+				return "", fmt.Errorf("signature database %d is outdated: age %s exceeds %s", version.Database, age.Round(time.Minute), a.MaxDatabaseAge)
+			}
+			return fmt.Sprintf("signature database %d is up to date", version.Database), nil
+		})
+	}
+
+	if a.MaxQueueLength > 0 {
+		check("queue", func() (string, error) {
+			stats, err := a.client.Stats(ctx)
+			if err != nil {
+				return "", err
+			}
+			if stats.Queue > a.MaxQueueLength {
+				return "", fmt.Errorf("queue length %d exceeds %d", stats.Queue, a.MaxQueueLength)
+			}
+			return fmt.Sprintf("queue length is %d", stats.Queue), nil
+		})
+	}
+
+	return returnJSON(e, statusCode, resp)
+}
+
 func (a *API) Reload(e echo.Context) error {
 	err := a.client.Reload(e.Request().Context())
 	resp := newResponse()
@@ -91,7 +439,7 @@ func (a *API) Reload(e echo.Context) error {
 	if err != nil {
 		a.Log.Error("Failed to reload clamav", "error", err)
 		resp.Results = append(resp.Results, Result{Status: "failed", Details: "clamav is not ready"})
-		statusCode = 502
+		statusCode = clientErrorStatus(e, err)
 
 	} else {
 		resp.Results = append(resp.Results, Result{Status: "success", Details: "triggered reload"})
@@ -108,10 +456,26 @@ func (a *API) Stats(e echo.Context) error {
 	if err != nil {
 		a.Log.Error("Failed to get stats of clamav", "error", err)
 		resp.Results = append(resp.Results, Result{Status: "failed", Details: err.Error()})
-		statusCode = 502
+		statusCode = clientErrorStatus(e, err)
 	} else {
 		resp.Results = append(resp.Results, Result{Status: "success", Details: stats})
 	}
 
 	return returnJSON(e, statusCode, resp)
 }
+
+func (a *API) Version(e echo.Context) error {
+	version, err := a.client.Version(e.Request().Context())
+	resp := newResponse()
+	statusCode := 200
+
+	if err != nil {
+		a.Log.Error("Failed to get version of clamav", "error", err)
+		resp.Results = append(resp.Results, Result{Status: "failed", Details: err.Error()})
+		statusCode = clientErrorStatus(e, err)
+	} else {
+		resp.Results = append(resp.Results, Result{Status: "success", Details: version})
+	}
+
+	return returnJSON(e, statusCode, resp)
+}
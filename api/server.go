@@ -4,12 +4,19 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ron96G/clamav-facade/archive"
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/clamav-facade/fetch"
+	"github.com/ron96G/clamav-facade/webhook"
 	log "github.com/ron96G/go-common-utils/log"
 
 	"github.com/labstack/echo-contrib/jaegertracing"
@@ -20,7 +27,8 @@ import (
 
 var (
 	OpsSkipper = func(c echo.Context) bool {
-		return strings.HasPrefix(c.Path(), "/health") || strings.HasPrefix(c.Path(), "/ping") || c.Path() == "/metrics"
+		return strings.HasPrefix(c.Path(), "/health") || strings.HasPrefix(c.Path(), "/ping") ||
+			strings.HasPrefix(c.Path(), "/livez") || strings.HasPrefix(c.Path(), "/readyz") || c.Path() == "/metrics"
 	}
 
 	LoggerConfig = echo_mw.LoggerConfig{
@@ -39,15 +47,26 @@ var (
 
 func NewAPI(prefix, addr string, client Client, stopChan <-chan struct{}, logger log.Logger, tlsCfg *tls.Config) *API {
 	api := &API{
-		Prefix:       prefix,
-		Addr:         addr,
-		client:       client,
-		router:       echo.New(),
-		tlsCfg:       tlsCfg,
-		StopChan:     stopChan,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Prefix:        prefix,
+		Addr:          addr,
+		client:        client,
+		router:        echo.New(),
+		tlsCfg:        tlsCfg,
+		StopChan:      stopChan,
+		WriteTimeout:  15 * time.Second,
+		ReadTimeout:   15 * time.Second,
+		IdleTimeout:   60 * time.Second,
+		BatchPolicy:   Continue,
+		Fetchers:      fetch.NewRemoteRegistry(&fetch.Guard{MaxRedirects: 5}, 30*time.Second),
+		ArchiveLimits: archive.DefaultLimits,
+		Webhooks:      webhook.NewSender((&fetch.Guard{}).Client(10*time.Second), nil),
+		JobWorkers:    4,
+		JobQueueSize:  100,
+		JobTTL:        time.Hour,
+		JobTimeout:    30 * time.Minute,
+		jobs: jobQueue{
+			jobs: map[string]*Job{},
+		},
 	}
 	api.Log = logger
 
@@ -67,12 +86,21 @@ func NewAPI(prefix, addr string, client Client, stopChan <-chan struct{}, logger
 	p := prometheus.NewPrometheus("clamav_facade", OpsSkipper)
 	p.Use(api.router)
 
-	subrouter := api.router.Group(prefix)
+	subrouter := api.router.Group(prefix, api.requestTimeout)
 	// resources
 	subrouter.POST("/scan", api.Scan)
+	subrouter.POST("/scan/raw", api.ScanRaw)
+	subrouter.POST("/scan/url", api.ScanURL)
+	subrouter.POST("/scan/email", api.ScanEmail)
+	subrouter.POST("/jobs", api.SubmitJob)
+	subrouter.GET("/jobs/:id", api.GetJob)
+	subrouter.DELETE("/jobs/:id", api.CancelJob)
 	subrouter.PUT("/reload", api.Reload)
 	subrouter.GET("/stats", api.Stats)
+	subrouter.GET("/version", api.Version)
 	subrouter.GET("/health", api.Ping)
+	subrouter.GET("/livez", api.Live)
+	subrouter.GET("/readyz", api.Ready)
 	subrouter.GET("/", api.Ping)
 
 	return api
@@ -96,6 +124,11 @@ func (a *API) Run() {
 		listener = tls.NewListener(listener, a.tlsCfg)
 	}
 
+	if a.StatsInterval > 0 {
+		go a.pollStats(a.StatsInterval)
+	}
+	a.warnUnsignedWebhooks()
+
 	schema := "http"
 	if a.tlsCfg != nil {
 		schema = "https"
@@ -118,6 +151,49 @@ func (a *API) Run() {
 	}
 }
 
+// requestTimeout limits the context of a request to 90% of the write timeout.
+// Calls to clamav fail with an error before the response can no longer be written.
+// Jobs are not affected since they do not use the context of the request.
+func (a *API) requestTimeout(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(e echo.Context) error {
+		if a.WriteTimeout <= 0 {
+			return next(e)
+		}
+		ctx, cancel := context.WithTimeout(e.Request().Context(), time.Duration(float64(a.WriteTimeout)*0.9))
+		defer cancel()
+		e.SetRequest(e.Request().WithContext(ctx))
+		return next(e)
+	}
+}
+
+// clientErrorStatus returns the status code for an error of the client.
+// If the circuit breaker is open, the Retry-After header is set.
+func clientErrorStatus(e echo.Context, err error) int {
+	setRetryAfter(e, err)
+	return errorStatus(err)
+}
+
+func errorStatus(err error) int {
+	var sourceErr *clamav.SourceError
+	switch {
+	case errors.As(err, &sourceErr):
+		// the file could not be read, e.g. because the upload broke off
+		return http.StatusBadRequest
+	case errors.Is(err, clamav.ErrCircuitOpen):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// setRetryAfter sets the Retry-After header if err was caused by an open circuit breaker
+func setRetryAfter(e echo.Context, err error) {
+	var openErr *clamav.CircuitOpenError
+	if errors.As(err, &openErr) {
+		retryAfter := int(math.Ceil(openErr.RetryAfter.Seconds()))
+		e.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+}
+
 func returnJSON(e echo.Context, statusCode int, obj interface{}) (err error) {
 	resp := e.Response()
 
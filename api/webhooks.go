@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+
+	echo "github.com/labstack/echo/v4"
+	"github.com/ron96G/clamav-facade/webhook"
+)
+
+const (
+	EventScanCompleted = "scan.completed"
+	EventScanInfected  = "scan.infected"
+
+	// callbackKey is the key of the callback url in the echo context
+	callbackKey = "callback_url"
+)
+
+// setCallback validates rawURL and stores it as callback of the request
+func (a *API) setCallback(e echo.Context, rawURL string) error {
+	if rawURL == "" {
+		return nil
+	}
+	if a.Webhooks == nil {
+		return errors.New("callbacks are disabled")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return errors.New("callback_url must be an absolute http(s) url")
+	}
+	e.Set(callbackKey, u.String())
+	return nil
+}
+
+// readCallback reads the callback url of a multipart form field
+func (a *API) readCallback(e echo.Context, r io.Reader) error {
+	b, err := io.ReadAll(io.LimitReader(r, 4096))
+	if err != nil {
+		return err
+	}
+	return a.setCallback(e, strings.TrimSpace(string(b)))
+}
+
+func (a *API) invalidCallback(e echo.Context, err error) error {
+	a.Log.Warn("Rejected callback_url", "error", err)
+	resp := newResponse()
+	resp.Results = append(resp.Results, Result{Status: "failed", Code: 400, Error: ErrCodeInvalidRequest, Details: "invalid callback_url: " + err.Error()})
+	return returnJSON(e, 400, resp)
+}
+
+func callbackURL(e echo.Context) string {
+	u, _ := e.Get(callbackKey).(string)
+	return u
+}
+
+// notify delivers the payload of a finished scan to the callback url and,
+// if a virus was found, to the infection webhook. Deliveries run in the background.
+func (a *API) notify(callback string, resp *Response, payload interface{}) {
+	if callback != "" && a.Webhooks != nil {
+		go a.deliver(a.Webhooks, callback, EventScanCompleted, payload)
+	}
+	if sender := a.infectionSender(); sender != nil && a.InfectionWebhook != "" && resp.Summary != nil && resp.Summary.Infected > 0 {
+		go a.deliver(sender, a.InfectionWebhook, EventScanInfected, payload)
+	}
+}
+
+func (a *API) infectionSender() *webhook.Sender {
+	if a.InfectionSender != nil {
+		return a.InfectionSender
+	}
+	return a.Webhooks
+}
+
+// warnUnsignedWebhooks logs a warning for every sender without a secret, since receivers can not verify its deliveries
+func (a *API) warnUnsignedWebhooks() {
+	if a.Webhooks != nil && len(a.Webhooks.Secret) == 0 {
+		a.Log.Warn("Callbacks are not signed since the webhook secret is empty")
+	}
+	if sender := a.infectionSender(); a.InfectionWebhook != "" && sender != nil && len(sender.Secret) == 0 {
+		a.Log.Warn("Deliveries to the infection webhook are not signed since the webhook secret is empty", "url", a.InfectionWebhook)
+	}
+}
+
+func (a *API) deliver(sender *webhook.Sender, url, event string, payload interface{}) {
+	if err := sender.Send(context.Background(), url, event, payload); err != nil {
+		a.Log.Warn("Failed to deliver webhook", "url", url, "event", event, "error", err)
+		return
+	}
+	a.Log.Debug("Delivered webhook", "url", url, "event", event)
+}
@@ -0,0 +1,282 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ErrLimitExceeded is wrapped by the errors of exceeded limits
+var ErrLimitExceeded = errors.New("archive limit exceeded")
+
+// Limits stop archives which would exhaust the resources, e.g. zip bombs. A value of 0 disables a limit.
+type Limits struct {
+	// MaxDepth is the maximum nesting of archives, e.g. 2 for a zip in a tar.gz
+	MaxDepth int
+	// MaxEntries is the maximum number of entries of all nested archives
+	MaxEntries int
+	// MaxRatio is the maximum ratio between the uncompressed and the compressed size of an entry
+	MaxRatio float64
+	// MaxSize is the maximum number of uncompressed bytes of all entries.
+	// It also limits the total size of the zip archives which are buffered on disk.
+	MaxSize int64
+}
+
+var DefaultLimits = Limits{
+	MaxDepth:   5,
+	MaxEntries: 10000,
+	MaxRatio:   100,
+	MaxSize:    1 << 30,
+}
+
+// ratioThreshold is the size up to which the compression ratio is not checked.
+// Small files, e.g. text with repeated lines, are legitimately compressed very well.
+const ratioThreshold = 1 << 20
+
+// Entry is a file of an archive which is not an archive itself
+type Entry struct {
+	// Path is the path of the entry, e.g. 'lib/inner.zip/evil.exe'. It is empty if the input is not an archive.
+	Path string
+	// Body is the uncompressed content of the entry. It is only valid until fn returns.
+	Body io.Reader
+}
+
+// Walk calls fn for every entry of the zip, tar or gzip archive in r. Nested archives are expanded
+// up to the limits. If r is not an archive, fn is called once for r.
+// The formats are detected by their content rather than their names.
+func Walk(r io.Reader, limits Limits, fn func(*Entry) error) error {
+	w := &walker{limits: limits, fn: fn}
+	err := w.walk(r, "", 0)
+	if w.err != nil {
+		// the limit is reported rather than the failure of the reader which it caused
+		return w.err
+	}
+	return err
+}
+
+type walker struct {
+	limits  Limits
+	fn      func(*Entry) error
+	entries int
+	size    int64
+	// spooled is the number of bytes of all zip archives which were buffered on disk
+	spooled int64
+	// err is the exceeded limit of the reader of an entry
+	err error
+}
+
+type format int
+
+const (
+	formatNone format = iota
+	formatZip
+	formatTar
+	formatGzip
+)
+
+func detect(head []byte) format {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return formatZip
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return formatGzip
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return formatTar
+	}
+	return formatNone
+}
+
+func (w *walker) walk(r io.Reader, name string, depth int) error {
+	br := bufio.NewReaderSize(r, 512)
+	head, _ := br.Peek(512)
+	kind := detect(head)
+	if kind == formatNone {
+		return w.leaf(br, name)
+	}
+	if w.limits.MaxDepth > 0 && depth >= w.limits.MaxDepth {
+		return fmt.Errorf("%w: %s is nested deeper than %d archives", ErrLimitExceeded, display(name), w.limits.MaxDepth)
+	}
+
+	switch kind {
+	case formatZip:
+		return w.walkZip(br, name, depth+1)
+	case formatTar:
+		return w.walkTar(br, name, depth+1)
+	default:
+		return w.walkGzip(br, name, depth+1)
+	}
+}
+
+// leaf calls fn for a file which is not an archive
+func (w *walker) leaf(r io.Reader, name string) error {
+	if err := w.fn(&Entry{Path: name, Body: &sizeReader{r: r, w: w}}); err != nil {
+		return err
+	}
+	return w.err
+}
+
+// entry counts an entry of an archive
+func (w *walker) entry() error {
+	w.entries++
+	if w.limits.MaxEntries > 0 && w.entries > w.limits.MaxEntries {
+		return fmt.Errorf("%w: more than %d entries", ErrLimitExceeded, w.limits.MaxEntries)
+	}
+	return nil
+}
+
+func (w *walker) walkTar(r io.Reader, name string, depth int) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar %s: %w", display(name), err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if err := w.entry(); err != nil {
+			return err
+		}
+		if err := w.walk(tr, join(name, hdr.Name), depth); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *walker) walkGzip(r io.Reader, name string, depth int) error {
+	compressed := &countReader{r: r}
+	gz, err := gzip.NewReader(compressed)
+	if err != nil {
+		return fmt.Errorf("failed to read gzip %s: %w", display(name), err)
+	}
+	defer gz.Close()
+
+	// the content of a gzip is part of the same path, e.g. the entries of a tar.gz
+	return w.walk(&ratioReader{r: gz, compressed: compressed, name: name, w: w}, name, depth)
+}
+
+func (w *walker) walkZip(r io.Reader, name string, depth int) error {
+	// zip archives are read from their end, so they are buffered on disk
+	f, err := os.CreateTemp("", "archive-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// nested zip archives are buffered as well, so the limit applies to all of them
+	if w.limits.MaxSize > 0 {
+		r = io.LimitReader(r, w.limits.MaxSize-w.spooled+1)
+	}
+	n, err := io.Copy(f, r)
+	w.spooled += n
+	if err != nil {
+		return err
+	}
+	if w.limits.MaxSize > 0 && w.spooled > w.limits.MaxSize {
+		return fmt.Errorf("%w: zip archives up to %s are larger than %d bytes", ErrLimitExceeded, display(name), w.limits.MaxSize)
+	}
+
+	zr, err := zip.NewReader(f, n)
+	if err != nil {
+		return fmt.Errorf("failed to read zip %s: %w", display(name), err)
+	}
+	for _, file := range zr.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		if err := w.entry(); err != nil {
+			return err
+		}
+		entryName := join(name, file.Name)
+		if w.limits.MaxRatio > 0 && file.UncompressedSize64 > ratioThreshold && float64(file.UncompressedSize64) > w.limits.MaxRatio*float64(file.CompressedSize64) {
+			return fmt.Errorf("%w: compression ratio of %s exceeds %g", ErrLimitExceeded, entryName, w.limits.MaxRatio)
+		}
+		// the declared size is enforced while reading
+		rc, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("failed to read zip %s: %w", display(entryName), err)
+		}
+		err = w.walk(rc, entryName, depth)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sizeReader enforces the maximum size of all entries
+type sizeReader struct {
+	r io.Reader
+	w *walker
+}
+
+func (s *sizeReader) Read(p []byte) (int, error) {
+	if s.w.err != nil {
+		return 0, s.w.err
+	}
+	n, err := s.r.Read(p)
+	s.w.size += int64(n)
+	if s.w.limits.MaxSize > 0 && s.w.size > s.w.limits.MaxSize {
+		s.w.err = fmt.Errorf("%w: entries are larger than %d bytes", ErrLimitExceeded, s.w.limits.MaxSize)
+		return 0, s.w.err
+	}
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ratioReader enforces the compression ratio of a stream
+type ratioReader struct {
+	r          io.Reader
+	compressed *countReader
+	n          int64
+	name       string
+	w          *walker
+}
+
+func (rr *ratioReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	if rr.w.limits.MaxRatio > 0 && rr.n > ratioThreshold && float64(rr.n) > rr.w.limits.MaxRatio*float64(rr.compressed.n) {
+		rr.w.err = fmt.Errorf("%w: compression ratio of %s exceeds %g", ErrLimitExceeded, display(rr.name), rr.w.limits.MaxRatio)
+		return 0, rr.w.err
+	}
+	return n, err
+}
+
+func join(name, entry string) string {
+	entry = strings.TrimPrefix(path.Clean("/"+entry), "/")
+	if name == "" {
+		return entry
+	}
+	return name + "/" + entry
+}
+
+func display(name string) string {
+	if name == "" {
+		return "archive"
+	}
+	return name
+}
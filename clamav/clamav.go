@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/ron96G/clamav-facade/fetch"
 	log "github.com/ron96G/go-common-utils/log"
 )
 
@@ -18,55 +22,149 @@ var (
 	CHUNK_SIZE     = 2048
 	defaultMaxSize = int(25 * 1000 * 1000)
 	DELIM          = []byte("\000\000\000\000")
+
+	ErrNotReady = errors.New("clamav is not ready yet")
 )
 
 // For Docs see https://manpages.debian.org/testing/clamav-daemon/clamd.8.en.html
 type ClamavClient struct {
-	Hostname        string
-	Port            uint
+	Network         string
+	Address         string
 	DefaultTimeout  time.Duration
 	StreamMaxLength uint32
 	Log             log.Logger
 	MaxSize         int
-	remoteAddr      *net.TCPAddr
-	bufferPool      sync.Pool
+	Retry           RetryPolicy
+	// Fetchers provides the objects of ScanFile. If it is nil, fetch.DefaultRegistry is used.
+	Fetchers *fetch.Registry
+	// ScanVersion requests the version of clamd along with every scan, see ScanResult.Version
+	ScanVersion bool
+	dialer      net.Dialer
+	pool        *Pool
+	breaker     *CircuitBreaker
+	bufferPool  sync.Pool
 }
 
 func NewClamavClient(hostname string, port uint, timeout time.Duration) (c *ClamavClient, err error) {
+	return newClamavClient("tcp", net.JoinHostPort(hostname, strconv.FormatUint(uint64(port), 10)), timeout)
+}
+
+// NewClamavClientFromAddress creates a new client for the given address.
+// Supported are 'unix:///path/to/clamd.ctl', 'tcp://host:port' and 'host:port'.
+func NewClamavClientFromAddress(rawAddr string, timeout time.Duration) (c *ClamavClient, err error) {
+	network, address, err := ParseAddress(rawAddr)
+	if err != nil {
+		return nil, err
+	}
+	return newClamavClient(network, address, timeout)
+}
+
+func newClamavClient(network, address string, timeout time.Duration) (c *ClamavClient, err error) {
 	c = &ClamavClient{
-		Hostname:       hostname,
-		Port:           port,
+		Network:        network,
+		Address:        address,
 		DefaultTimeout: timeout,
 		MaxSize:        defaultMaxSize,
 		Log:            log.New("clamav_client"),
+		dialer: net.Dialer{
+			Timeout: timeout,
+		},
 		bufferPool: sync.Pool{
 			New: func() interface{} {
 				return bytes.NewBuffer(nil)
 			},
 		},
 	}
-	c.remoteAddr, err = net.ResolveTCPAddr("tcp", c.address())
-	if err != nil {
-		return nil, err
+	if network == "tcp" {
+		if _, _, err = net.SplitHostPort(address); err != nil {
+			return nil, err
+		}
 	}
 	return c, nil
 }
 
+// ParseAddress returns the network and address of the given clamd address
+func ParseAddress(rawAddr string) (network, address string, err error) {
+	if !strings.Contains(rawAddr, "://") {
+		return "tcp", rawAddr, nil
+	}
+
+	uri, err := url.Parse(rawAddr)
+	if err != nil {
+		return "", "", err
+	}
+	switch uri.Scheme {
+	case "unix":
+		address = uri.Path
+		if uri.Host != "" {
+			// e.g. 'unix://clamd.ctl' is a relative path
+			address = uri.Host + uri.Path
+		}
+		if address == "" {
+			return "", "", fmt.Errorf("missing socket path in address %q", rawAddr)
+		}
+		return "unix", address, nil
+
+	case "tcp":
+		if uri.Port() == "" {
+			return "", "", fmt.Errorf("missing port in address %q", rawAddr)
+		}
+		return "tcp", uri.Host, nil
+
+	default:
+		return "", "", fmt.Errorf("unsupported scheme %q in address %q", uri.Scheme, rawAddr)
+	}
+}
+
 func (c *ClamavClient) SetDefaultTimeout(timeout time.Duration) {
 	c.DefaultTimeout = timeout
+	c.dialer.Timeout = timeout
 }
 
 func (c *ClamavClient) SetMaxSize(size int) {
 	c.MaxSize = size
 }
 
-func (c *ClamavClient) address() string {
-	return fmt.Sprintf("%s:%d", c.Hostname, c.Port)
+// Addr returns the address of clamd including the network, e.g. 'tcp://localhost:3310'
+func (c *ClamavClient) Addr() string {
+	return fmt.Sprintf("%s://%s", c.Network, c.Address)
+}
+
+func (c *ClamavClient) SetRetryPolicy(policy RetryPolicy) {
+	c.Retry = policy
+}
+
+// EnableCircuitBreaker stops sending requests to clamd after consecutive failures
+// until the cooldown has passed
+func (c *ClamavClient) EnableCircuitBreaker(opts BreakerOptions) {
+	c.breaker = NewCircuitBreaker(c.Addr(), opts)
+}
+
+// Breaker returns the circuit breaker of the client or nil if it is disabled
+func (c *ClamavClient) Breaker() *CircuitBreaker {
+	return c.breaker
+}
+
+// EnablePool configures the client to reuse connections to clamd using the IDSESSION protocol.
+// RELOAD and SHUTDOWN are not supported within a session and always use a new connection.
+func (c *ClamavClient) EnablePool(opts PoolOptions) {
+	c.pool = NewPool(c.dial, opts, c.Log)
+}
+
+// Close releases all pooled connections
+func (c *ClamavClient) Close() {
+	if c.pool != nil {
+		c.pool.Close()
+	}
+}
+
+func (c *ClamavClient) dial(ctx context.Context) (net.Conn, error) {
+	c.Log.Debug("connecting to clamav", "address", c.Addr())
+	return c.dialer.DialContext(ctx, c.Network, c.Address)
 }
 
 func (c *ClamavClient) getConn(ctx context.Context) (conn net.Conn, err error) {
-	c.Log.Debug("connecting to clamav", "address", c.remoteAddr)
-	conn, err = net.DialTCP("tcp", nil, c.remoteAddr)
+	conn, err = c.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -76,37 +174,68 @@ func (c *ClamavClient) getConn(ctx context.Context) (conn net.Conn, err error) {
 	}
 	c.Log.Debug("setting deadline", "deadline", deadline)
 	err = conn.SetDeadline(deadline)
+	return
+}
+
+// watchContext interrupts all pending operations on conn once ctx is done.
+// The returned function must be called to stop watching.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
 	go func() {
-		<-ctx.Done()
-		c.Log.Debug("closing connection")
-		c.releaseConn(conn)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
 	}()
-
-	return
+	return func() { close(done) }
 }
 
 func (c *ClamavClient) releaseConn(conn net.Conn) {
 	conn.Close()
 }
 
-func (c *ClamavClient) borrowBuffer() *bytes.Buffer {
-	return c.bufferPool.Get().(*bytes.Buffer)
-}
-
-func (c *ClamavClient) releaseBuffer(buf *bytes.Buffer) {
-	c.bufferPool.Put(buf)
+// do sends the command to clamd and returns the reply. If the pool is enabled,
+// sessionCommand is used within a session, otherwise command is sent on a new connection.
+// If payload is not nil, it is sent as INSTREAM chunks after the command.
+func (c *ClamavClient) do(ctx context.Context, command, sessionCommand string, payload io.Reader) (resp string, written int, err error) {
+	if c.pool != nil {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.DefaultTimeout)
+			defer cancel()
+		}
+		return c.pool.Do(ctx, sessionCommand, payload)
+	}
+	return c.exchange(ctx, command, payload, "")
 }
 
-func (c *ClamavClient) Ping(ctx context.Context) (err error) {
-	conn, err := c.getConn(ctx)
+// exchange sends the command on a new connection and reads the reply until clamd closes the connection.
+// If payload is not nil, it is sent as INSTREAM chunks after the command, followed by trailer.
+func (c *ClamavClient) exchange(ctx context.Context, command string, payload io.Reader, trailer string) (resp string, written int, err error) {
+	var conn net.Conn
+	conn, err = c.getConn(ctx)
 	if err != nil {
-		return err
+		return "", 0, fmt.Errorf("%w: failed to obtain connection", err)
 	}
 	defer c.releaseConn(conn)
+	defer watchContext(ctx, conn)()
 
-	_, err = conn.Write([]byte("PING\000"))
+	_, err = conn.Write([]byte(command))
 	if err != nil {
-		return err
+		return "", 0, fmt.Errorf("%w: failed to write command", err)
+	}
+
+	if payload != nil {
+		written, err = writeStream(conn, payload)
+		if err != nil {
+			return "", written, err
+		}
+	}
+	if trailer != "" {
+		if _, err = conn.Write([]byte(trailer)); err != nil {
+			return "", written, fmt.Errorf("%w: failed to write command", err)
+		}
 	}
 
 	buf := c.borrowBuffer()
@@ -114,41 +243,98 @@ func (c *ClamavClient) Ping(ctx context.Context) (err error) {
 	defer c.releaseBuffer(buf)
 	_, err = io.Copy(buf, conn)
 	if err != nil && err != io.EOF {
+		return "", written, fmt.Errorf("%w: failed to read response", err)
+	}
+	return buf.String(), written, nil
+}
+
+// SourceError is returned if the object which should be scanned could not be read.
+// It is not caused by clamav and therefore never retried.
+type SourceError struct {
+	Err error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("%s: failed to read chunk", e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// writeStream sends obj as INSTREAM chunks followed by the termination chunk
+func writeStream(w io.Writer, obj io.Reader) (written int, err error) {
+	chunk := make([]byte, CHUNK_SIZE)
+	chunkSize := make([]byte, 4)
+	for {
+		n, err := obj.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunkSize, uint32(n))
+			if _, err := w.Write(chunkSize); err != nil {
+				return written, fmt.Errorf("%w: failed to write chunksize", err)
+			}
+			if _, err := w.Write(chunk[:n]); err != nil {
+				return written, fmt.Errorf("%w: failed to write chunk", err)
+			}
+			written += n
+		}
+		if err != nil {
+			if err != io.EOF {
+				return written, &SourceError{Err: err}
+			}
+			break
+		}
+	}
+
+	if _, err = w.Write(DELIM); err != nil {
+		return written, fmt.Errorf("%w: failed to write termination", err)
+	}
+	return written, nil
+}
+
+func (c *ClamavClient) borrowBuffer() *bytes.Buffer {
+	return c.bufferPool.Get().(*bytes.Buffer)
+}
+
+func (c *ClamavClient) releaseBuffer(buf *bytes.Buffer) {
+	c.bufferPool.Put(buf)
+}
+
+func (c *ClamavClient) Ping(ctx context.Context) (err error) {
+	return c.call(ctx, nil, func() error {
+		return c.ping(ctx)
+	})
+}
+
+func (c *ClamavClient) ping(ctx context.Context) (err error) {
+	resp, _, err := c.do(ctx, "PING\000", "zPING\000", nil)
+	if err != nil {
 		return err
 	}
-	resp := buf.String()
 	c.Log.Debug("successfully read ping response", "response", resp)
-	if strings.TrimSpace(resp) == "PONG" {
+	if trimReply(resp) == "PONG" {
 		return nil
 	}
-	return fmt.Errorf("clamav is not ready yet")
+	return ErrNotReady
 }
 
-func (c *ClamavClient) Version(ctx context.Context) (version string, err error) {
-	var conn net.Conn
-	conn, err = c.getConn(ctx)
-	if err != nil {
-		return "", fmt.Errorf("%w: failed to obtain connection", err)
-	}
-	defer c.releaseConn(conn)
+func (c *ClamavClient) Version(ctx context.Context) (version *VersionInfo, err error) {
+	err = c.call(ctx, nil, func() error {
+		version, err = c.version(ctx)
+		return err
+	})
+	return version, err
+}
 
-	_, err = conn.Write([]byte("VERSION\000"))
+func (c *ClamavClient) version(ctx context.Context) (version *VersionInfo, err error) {
+	resp, _, err := c.do(ctx, "VERSION\000", "zVERSION\000", nil)
 	if err != nil {
-		return "", fmt.Errorf("%w: failed to write command", err)
-	}
-
-	buf := c.borrowBuffer()
-	buf.Reset()
-	defer c.releaseBuffer(buf)
-	_, err = io.Copy(buf, conn)
-	if err != nil && err != io.EOF {
-		return "", fmt.Errorf("%w: failed to read response", err)
+		return nil, err
 	}
 
-	resp := string(bytes.Trim(buf.Bytes(), "\x00"))
-	resp = strings.TrimSpace(resp)
-	c.Log.Debug("Successfully read ping response", "response", resp)
-	return resp, nil
+	resp = trimReply(resp)
+	c.Log.Debug("Successfully read version response", "response", resp)
+	return ParseVersion(resp)
 }
 
 func (c *ClamavClient) Reload(ctx context.Context) (err error) {
@@ -192,118 +378,129 @@ func (c *ClamavClient) Shutdown(ctx context.Context) {
 	}
 }
 
-func (c *ClamavClient) Stats(ctx context.Context) (stats string, err error) {
-	var conn net.Conn
-	conn, err = c.getConn(ctx)
-	if err != nil {
-		c.Log.Warn("failed to get conn", "error", err)
-		return "", fmt.Errorf("%w: failed to obtain connection", err)
-	}
-	defer c.releaseConn(conn)
+func (c *ClamavClient) Stats(ctx context.Context) (stats *Stats, err error) {
+	err = c.call(ctx, nil, func() error {
+		stats, err = c.stats(ctx)
+		return err
+	})
+	return stats, err
+}
 
-	_, err = conn.Write([]byte("zSTATS\000"))
+func (c *ClamavClient) stats(ctx context.Context) (stats *Stats, err error) {
+	resp, _, err := c.do(ctx, "zSTATS\000", "zSTATS\000", nil)
 	if err != nil {
-		return "", fmt.Errorf("%w: failed to write command", err)
-	}
-
-	buf := c.borrowBuffer()
-	buf.Reset()
-	defer c.releaseBuffer(buf)
-	_, err = io.Copy(buf, conn)
-	if err != nil && err != io.EOF {
-		return "", fmt.Errorf("%w: failed to read response", err)
+		c.Log.Warn("failed to get stats", "error", err)
+		return nil, err
 	}
 
-	resp := strings.TrimSpace(buf.String())
-	c.Log.Debug("successfully read reload response", "response", resp)
-	return resp, nil
+	resp = trimReply(resp)
+	c.Log.Debug("successfully read stats response", "response", resp)
+	return ParseStats(resp)
 }
 
-func (c *ClamavClient) ScanFile(ctx context.Context, rawURL string) (ok bool, err error) {
-	var obj io.Reader
-	var n int
-
-	n, obj, err = download(rawURL)
+// ScanFile streams the object of rawURL to clamav. The object is fetched by the fetcher of the url scheme,
+// plain paths are read from disk. The size limit is checked before and enforced while streaming.
+func (c *ClamavClient) ScanFile(ctx context.Context, rawURL string) (res *ScanResult, err error) {
+	fetchers := c.Fetchers
+	if fetchers == nil {
+		fetchers = fetch.DefaultRegistry
+	}
+	obj, err := fetchers.Fetch(ctx, rawURL)
 	if err != nil {
-		n, obj, err = readFile(rawURL)
-		if err != nil {
-			return false, err
-		}
+		return nil, err
 	}
-	c.Log.Debug("Trying to scan file", "filename", rawURL, "length", n)
-	if !c.CheckFilesize(n) {
-		return false, fmt.Errorf("file exceeded size limit")
+	defer obj.Body.Close()
+
+	c.Log.Debug("Trying to scan file", "filename", rawURL, "length", obj.Size)
+	if obj.Size > 0 && !c.CheckFilesize(int(obj.Size)) {
+		return nil, ErrFileTooLarge
 	}
-	return c.Scan(ctx, obj)
+	return c.Scan(ctx, LimitReader(obj.Body, c.MaxFilesize()))
 }
 
-func (c *ClamavClient) Scan(ctx context.Context, obj io.Reader) (ok bool, err error) {
-	var conn net.Conn
-	var written int
+// Scan sends obj to clamav. Failed scans are only retried if obj implements io.Seeker.
+func (c *ClamavClient) Scan(ctx context.Context, obj io.Reader) (res *ScanResult, err error) {
+	err = c.call(ctx, obj, func() error {
+		res, err = c.scan(ctx, obj)
+		return err
+	})
+	return res, err
+}
 
-	conn, err = c.getConn(ctx)
+func (c *ClamavClient) scan(ctx context.Context, obj io.Reader) (res *ScanResult, err error) {
+	start := time.Now()
+
+	var resp, version string
+	var written int
+	if c.ScanVersion {
+		resp, version, written, err = c.scanWithVersion(ctx, obj)
+	} else {
+		resp, written, err = c.do(ctx, "zINSTREAM\000", "zINSTREAM\000", obj)
+	}
 	if err != nil {
-		return false, fmt.Errorf("%w: failed to obtain connection", err)
+		return nil, err
 	}
+	c.Log.Info("successfully sent file to clamav", "sent_bytes", written)
 
-	_, err = conn.Write([]byte("zINSTREAM\000"))
+	res, err = newScanResult(resp, int64(written), time.Since(start))
 	if err != nil {
-		return false, fmt.Errorf("%w: failed to write command", err)
+		c.Log.Warn("clamav replied with an error", "response", res.Raw, "error", err)
+		return res, err
 	}
+	c.Log.Info("successfully read response", "response", res.Raw, "verdict", res.Verdict, "signatures", res.Signatures)
 
-	chunk := make([]byte, CHUNK_SIZE)
-	chunkSize := make([]byte, 4)
-	for {
-
-		n, err := obj.Read(chunk)
-		if err != nil {
-			if err != io.EOF {
-				return false, fmt.Errorf("%w: failed to read chunk", err)
-			}
-			c.Log.Debug("Reached EOF", "sum_sent_bytes", written+n)
-			break
+	if c.ScanVersion {
+		// the version is informational, the verdict is returned regardless
+		if res.Version, err = ParseVersion(version); err != nil {
+			c.Log.Warn("failed to read version of scan", "response", version, "error", err)
 		}
+	}
+	return res, nil
+}
 
-		binary.BigEndian.PutUint32(chunkSize, uint32(n))
-		_, err = conn.Write(chunkSize)
-		if err != nil {
-			return false, fmt.Errorf("%w: failed to write chunksize", err)
+// scanWithVersion sends obj and requests the version of clamd within the same session. Unlike a separate
+// call of Version, it names the signatures which produced the verdict, even if the client is part of a
+// BackendGroup or clamd reloaded its database in the meantime. The version is empty if it was not replied.
+func (c *ClamavClient) scanWithVersion(ctx context.Context, obj io.Reader) (resp, version string, written int, err error) {
+	if c.pool != nil {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.DefaultTimeout)
+			defer cancel()
 		}
-
-		writtenChunkSize, err := conn.Write(chunk[:n])
+		replies, written, err := c.pool.Pipeline(ctx, obj, "zINSTREAM\000", "zVERSION\000")
 		if err != nil {
-			return false, fmt.Errorf("%w: failed to write chunk", err)
+			return "", "", written, err
 		}
-		written += n
-		c.Log.Debug("written to clamav", "sent_bytes", written, "written_chunk", writtenChunkSize, "chunk_size", binary.BigEndian.Uint32(chunkSize))
+		return replies[0], replies[1], written, nil
 	}
 
-	_, err = conn.Write(DELIM)
+	raw, written, err := c.exchange(ctx, "zIDSESSION\000zINSTREAM\000", obj, "zVERSION\000zEND\000")
 	if err != nil {
-		return false, fmt.Errorf("%w: failed to write termination", err)
+		return "", "", written, err
 	}
-
-	c.Log.Info("successfully sent file to clamav", "sent_bytes", written)
-
-	buf := c.borrowBuffer()
-	buf.Reset()
-	defer c.releaseBuffer(buf)
-
-	_, err = io.Copy(buf, conn)
-	if err != nil {
-		if err != io.EOF {
-			return false, fmt.Errorf("%w: failed to read response", err)
+	replies := map[int]string{}
+	for _, line := range strings.Split(raw, "\000") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		id, data, err := parseSessionReply(line)
+		if err != nil {
+			return "", "", written, err
 		}
-		c.Log.Info("Buffer: ", "buffer", buf.String())
+		replies[id] = data
 	}
-	resp := buf.String()
-	c.Log.Info("successfully read response", "response", resp)
+	return replies[1], replies[2], written, nil
+}
 
-	if !strings.Contains(resp, "OK") {
-		// its a virus
-		return false, nil
-	}
-	return true, nil
+// trimReply removes the null-termination and surrounding whitespace of a reply
+func trimReply(resp string) string {
+	return strings.TrimSpace(strings.Trim(resp, "\000"))
+}
+
+// MaxFilesize returns the maximum size of the objects which are sent to clamav
+func (c *ClamavClient) MaxFilesize() int {
+	return c.MaxSize
 }
 
 func (c *ClamavClient) CheckFilesize(n int) (ok bool) {
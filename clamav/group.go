@@ -0,0 +1,310 @@
+package clamav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/ron96G/go-common-utils/log"
+)
+
+var ErrNoBackends = errors.New("no clamav backend available")
+
+type Strategy string
+
+const (
+	// RoundRobin distributes requests evenly across all healthy backends
+	RoundRobin Strategy = "round-robin"
+	// LeastOutstanding prefers the backend with the fewest requests in flight
+	LeastOutstanding Strategy = "least-outstanding"
+	// LeastQueue prefers the backend with the shortest queue as reported by STATS
+	LeastQueue Strategy = "least-queue"
+)
+
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case RoundRobin, LeastOutstanding, LeastQueue:
+		return Strategy(s), nil
+	}
+	return "", fmt.Errorf("unknown load balancing strategy %q", s)
+}
+
+type GroupOptions struct {
+	Strategy Strategy
+	// HealthInterval is the interval in which all backends are pinged.
+	// Unhealthy backends are ejected until they respond again.
+	HealthInterval time.Duration
+}
+
+var DefaultGroupOptions = GroupOptions{
+	Strategy:       RoundRobin,
+	HealthInterval: 5 * time.Second,
+}
+
+type backend struct {
+	client      *ClamavClient
+	healthy     int32
+	outstanding int64
+	queue       int64
+}
+
+func (b *backend) isHealthy() bool {
+	return atomic.LoadInt32(&b.healthy) == 1
+}
+
+func (b *backend) setHealthy(healthy bool) (changed bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	return atomic.SwapInt32(&b.healthy, v) != v
+}
+
+// BackendGroup distributes requests across multiple clamd instances
+type BackendGroup struct {
+	Log      log.Logger
+	opts     GroupOptions
+	backends []*backend
+	next     uint64
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func NewBackendGroup(clients []*ClamavClient, opts GroupOptions, logger log.Logger) (*BackendGroup, error) {
+	if len(clients) == 0 {
+		return nil, ErrNoBackends
+	}
+	if opts.Strategy == "" {
+		opts.Strategy = DefaultGroupOptions.Strategy
+	}
+	if opts.HealthInterval <= 0 {
+		opts.HealthInterval = DefaultGroupOptions.HealthInterval
+	}
+
+	g := &BackendGroup{
+		Log:  logger,
+		opts: opts,
+		stop: make(chan struct{}),
+	}
+	for _, c := range clients {
+		g.backends = append(g.backends, &backend{client: c, healthy: 1})
+	}
+	go g.healthCheck()
+	return g, nil
+}
+
+// Backends returns the clients of all backends
+func (g *BackendGroup) Backends() []*ClamavClient {
+	clients := make([]*ClamavClient, len(g.backends))
+	for i, b := range g.backends {
+		clients[i] = b.client
+	}
+	return clients
+}
+
+// Close stops the health checks and closes all backends
+func (g *BackendGroup) Close() {
+	g.once.Do(func() {
+		close(g.stop)
+		for _, b := range g.backends {
+			b.client.Close()
+		}
+	})
+}
+
+func (g *BackendGroup) healthCheck() {
+	ticker := time.NewTicker(g.opts.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			var wg sync.WaitGroup
+			for _, b := range g.backends {
+				wg.Add(1)
+				go func(b *backend) {
+					defer wg.Done()
+					g.check(b)
+				}(b)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+func (g *BackendGroup) check(b *backend) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.opts.HealthInterval)
+	defer cancel()
+
+	err := b.client.Ping(ctx)
+	if err == nil && g.opts.Strategy == LeastQueue {
+		var stats *Stats
+		if stats, err = b.client.Stats(ctx); err == nil {
+			atomic.StoreInt64(&b.queue, int64(stats.Queue))
+		}
+	}
+
+	if err != nil {
+		if b.setHealthy(false) {
+			g.Log.Warn("ejected unhealthy backend", "address", b.client.Addr(), "error", err)
+		}
+		return
+	}
+	if b.setHealthy(true) {
+		g.Log.Info("backend is healthy again", "address", b.client.Addr())
+	}
+}
+
+// candidates returns the backends in the order in which they should be tried.
+// If no backend is healthy, all backends are returned as a last resort.
+func (g *BackendGroup) candidates() []*backend {
+	healthy := make([]*backend, 0, len(g.backends))
+	for _, b := range g.backends {
+		if b.isHealthy() {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = append(healthy, g.backends...)
+	}
+
+	// rotate to distribute requests evenly among equally good backends
+	offset := int(atomic.AddUint64(&g.next, 1) % uint64(len(healthy)))
+	ordered := append(healthy[offset:len(healthy):len(healthy)], healthy[:offset]...)
+
+	switch g.opts.Strategy {
+	case LeastOutstanding:
+		sortBackends(ordered, func(b *backend) int64 { return atomic.LoadInt64(&b.outstanding) })
+	case LeastQueue:
+		sortBackends(ordered, func(b *backend) int64 {
+			return atomic.LoadInt64(&b.queue) + atomic.LoadInt64(&b.outstanding)
+		})
+	}
+	return ordered
+}
+
+// sortBackends is a stable insertion sort which keeps the rotation for backends of equal weight
+func sortBackends(backends []*backend, weight func(*backend) int64) {
+	for i := 1; i < len(backends); i++ {
+		for j := i; j > 0 && weight(backends[j]) < weight(backends[j-1]); j-- {
+			backends[j], backends[j-1] = backends[j-1], backends[j]
+		}
+	}
+}
+
+// do calls fn with the best backend. If the backend is not reachable,
+// it is ejected and the next backend is tried.
+func (g *BackendGroup) do(fn func(c *ClamavClient) error) (err error) {
+	err = ErrNoBackends
+	for _, b := range g.candidates() {
+		atomic.AddInt64(&b.outstanding, 1)
+		err = fn(b.client)
+		atomic.AddInt64(&b.outstanding, -1)
+
+		if errors.Is(err, ErrCircuitOpen) {
+			continue
+		}
+		if err == nil || !isConnError(err) {
+			return err
+		}
+		if b.setHealthy(false) {
+			g.Log.Warn("ejected unreachable backend", "address", b.client.Addr(), "error", err)
+		}
+	}
+	return err
+}
+
+// isConnError reports whether err occurred while connecting. In this case nothing
+// was sent to clamd and the request can be repeated with another backend.
+func isConnError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func (g *BackendGroup) Scan(ctx context.Context, obj io.Reader) (res *ScanResult, err error) {
+	err = g.do(func(c *ClamavClient) error {
+		res, err = c.Scan(ctx, obj)
+		return err
+	})
+	return res, err
+}
+
+func (g *BackendGroup) ScanFile(ctx context.Context, rawURL string) (res *ScanResult, err error) {
+	err = g.do(func(c *ClamavClient) error {
+		res, err = c.ScanFile(ctx, rawURL)
+		return err
+	})
+	return res, err
+}
+
+func (g *BackendGroup) Stats(ctx context.Context) (stats *Stats, err error) {
+	err = g.do(func(c *ClamavClient) error {
+		stats, err = c.Stats(ctx)
+		return err
+	})
+	return stats, err
+}
+
+func (g *BackendGroup) Version(ctx context.Context) (version *VersionInfo, err error) {
+	err = g.do(func(c *ClamavClient) error {
+		version, err = c.Version(ctx)
+		return err
+	})
+	return version, err
+}
+
+// Ping succeeds if at least one backend is ready
+func (g *BackendGroup) Ping(ctx context.Context) (err error) {
+	err = ErrNoBackends
+	for _, b := range g.candidates() {
+		if err = b.client.Ping(ctx); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Reload reloads the database of all backends
+func (g *BackendGroup) Reload(ctx context.Context) error {
+	var failed []string
+	for _, b := range g.backends {
+		if err := b.client.Reload(ctx); err != nil {
+			g.Log.Warn("failed to reload backend", "address", b.client.Addr(), "error", err)
+			failed = append(failed, fmt.Sprintf("%s: %s", b.client.Addr(), err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to reload backends: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Shutdown shuts down all backends
+func (g *BackendGroup) Shutdown(ctx context.Context) {
+	for _, b := range g.backends {
+		b.client.Shutdown(ctx)
+	}
+}
+
+// MaxFilesize returns the smallest limit of all backends,
+// because the backend which scans the object is not known in advance
+func (g *BackendGroup) MaxFilesize() int {
+	max := g.backends[0].client.MaxFilesize()
+	for _, b := range g.backends[1:] {
+		if size := b.client.MaxFilesize(); size < max {
+			max = size
+		}
+	}
+	return max
+}
+
+func (g *BackendGroup) CheckFilesize(n int) bool {
+	return n <= g.MaxFilesize()
+}
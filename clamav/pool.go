@@ -0,0 +1,423 @@
+package clamav
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/ron96G/go-common-utils/log"
+)
+
+var (
+	ErrPoolClosed    = errors.New("connection pool is closed")
+	ErrSessionClosed = errors.New("clamav session is closed")
+)
+
+// PoolOptions configures the session pool of the client
+type PoolOptions struct {
+	// MaxIdle is the maximum number of sessions kept open for reuse
+	MaxIdle int
+	// MaxIdleTime is the duration after which an unused session is closed.
+	// It should be lower than the 'IdleTimeout' of clamd.
+	MaxIdleTime time.Duration
+	// MaxLifetime is the duration after which a session is no longer reused
+	MaxLifetime time.Duration
+}
+
+var DefaultPoolOptions = PoolOptions{
+	MaxIdle:     4,
+	MaxIdleTime: 20 * time.Second,
+	MaxLifetime: 10 * time.Minute,
+}
+
+type dialFunc func(ctx context.Context) (net.Conn, error)
+
+// Pool keeps clamd connections open using the IDSESSION protocol.
+// Within a session each command is tagged with an ID by clamd and
+// replies are matched to their request by this ID. This allows multiple
+// requests to be pipelined on the same connection.
+// For Docs see https://manpages.debian.org/testing/clamav-daemon/clamd.8.en.html#IDSESSION
+type Pool struct {
+	opts   PoolOptions
+	dial   dialFunc
+	Log    log.Logger
+	mu     sync.Mutex
+	free   []*session
+	closed bool
+	stop   chan struct{}
+}
+
+func NewPool(dial dialFunc, opts PoolOptions, logger log.Logger) *Pool {
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = DefaultPoolOptions.MaxIdle
+	}
+	if opts.MaxIdleTime <= 0 {
+		opts.MaxIdleTime = DefaultPoolOptions.MaxIdleTime
+	}
+	if opts.MaxLifetime <= 0 {
+		opts.MaxLifetime = DefaultPoolOptions.MaxLifetime
+	}
+	p := &Pool{
+		opts: opts,
+		dial: dial,
+		Log:  logger,
+		stop: make(chan struct{}),
+	}
+	go p.cleanup()
+	return p
+}
+
+// Do sends the command to clamd and waits for the reply. If payload is not nil,
+// it is written as INSTREAM chunks after the command.
+// The number of bytes read from payload is returned alongside the reply.
+func (p *Pool) Do(ctx context.Context, command string, payload io.Reader) (reply string, written int, err error) {
+	replies, written, err := p.Pipeline(ctx, payload, command)
+	if err != nil {
+		return "", written, err
+	}
+	return replies[0], written, nil
+}
+
+// Pipeline sends the commands on the same session and waits for their replies. If payload is not nil,
+// it is written as INSTREAM chunks after the first command. Only the failure of the first command
+// is returned, the replies of the following commands are empty if they failed.
+func (p *Pool) Pipeline(ctx context.Context, payload io.Reader, commands ...string) (replies []string, written int, err error) {
+	for attempt := 0; ; attempt++ {
+		var s *session
+		var reused bool
+		s, reused, err = p.get(ctx)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: failed to obtain session", err)
+		}
+
+		var ch <-chan sessionReply
+		// the session is returned once the payload is written, so that only
+		// complete commands are pipelined on it
+		ch, written, err = s.send(ctx, commands[0], payload)
+		pending := []<-chan sessionReply{ch}
+		if err == nil {
+			for _, command := range commands[1:] {
+				next, _, sendErr := s.send(ctx, command, nil)
+				if sendErr != nil {
+					break
+				}
+				pending = append(pending, next)
+			}
+		}
+		p.put(s)
+		if err != nil {
+			// a reused session may have been closed by clamd in the meantime.
+			// If nothing was consumed from the payload, it is safe to try again.
+			var sourceErr *SourceError
+			if reused && written == 0 && attempt == 0 && !errors.As(err, &sourceErr) {
+				p.Log.Debug("retrying with new session", "error", err)
+				continue
+			}
+			return nil, written, err
+		}
+
+		replies = make([]string, len(commands))
+		for i, ch := range pending {
+			select {
+			case r := <-ch:
+				if r.err != nil && i == 0 {
+					return nil, written, r.err
+				}
+				replies[i] = r.data
+			case <-ctx.Done():
+				return nil, written, fmt.Errorf("%w: failed to read response", ctx.Err())
+			}
+		}
+		return replies, written, nil
+	}
+}
+
+// Close closes all sessions of the pool
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.stop)
+	for _, s := range p.free {
+		s.closeWhenDone()
+	}
+	p.free = nil
+}
+
+func (p *Pool) get(ctx context.Context) (s *session, reused bool, err error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, false, ErrPoolClosed
+	}
+	for len(p.free) > 0 {
+		s = p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		if p.usable(s, time.Now()) {
+			p.mu.Unlock()
+			return s, true, nil
+		}
+		s.closeWhenDone()
+	}
+	p.mu.Unlock()
+
+	s, err = p.open(ctx)
+	return s, false, err
+}
+
+func (p *Pool) put(s *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	// the idle time starts once the session is returned, however long writing the payload took
+	s.touch(now)
+	if p.closed || !p.usable(s, now) || len(p.free) >= p.opts.MaxIdle {
+		s.closeWhenDone()
+		return
+	}
+	p.free = append(p.free, s)
+}
+
+func (p *Pool) usable(s *session, now time.Time) bool {
+	return s.alive() &&
+		now.Sub(s.createdAt) < p.opts.MaxLifetime &&
+		s.idle(now) < p.opts.MaxIdleTime
+}
+
+func (p *Pool) open(ctx context.Context) (*session, error) {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	if _, err = conn.Write([]byte("zIDSESSION\000")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: failed to start session", err)
+	}
+	p.Log.Debug("opened new session")
+
+	now := time.Now()
+	s := &session{
+		conn:      conn,
+		createdAt: now,
+		lastUsed:  now,
+		nextID:    1,
+		pending:   make(map[int]chan sessionReply),
+		log:       p.Log,
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// cleanup periodically closes sessions which exceeded their idle time or lifetime
+func (p *Pool) cleanup() {
+	ticker := time.NewTicker(p.opts.MaxIdleTime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			free := p.free[:0]
+			for _, s := range p.free {
+				if p.usable(s, now) {
+					free = append(free, s)
+				} else {
+					s.closeWhenDone()
+				}
+			}
+			p.free = free
+			p.mu.Unlock()
+		}
+	}
+}
+
+type sessionReply struct {
+	data string
+	err  error
+}
+
+type session struct {
+	conn      net.Conn
+	createdAt time.Time
+	// lastUsed is the time the session was returned or received its last pending reply
+	lastUsed time.Time
+	log      log.Logger
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	nextID   int
+	pending  map[int]chan sessionReply
+	// readDeadline is the latest deadline of the pending requests
+	readDeadline time.Time
+	closing      bool
+	err          error
+}
+
+// idle returns the duration since the session was last used. Sessions which wait for replies are not idle.
+func (s *session) idle(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) > 0 {
+		return 0
+	}
+	return now.Sub(s.lastUsed)
+}
+
+func (s *session) touch(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUsed = now
+}
+
+func (s *session) alive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err == nil && !s.closing
+}
+
+// send writes the command and its payload. The returned channel receives the reply.
+func (s *session) send(ctx context.Context, command string, payload io.Reader) (ch <-chan sessionReply, written int, err error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, 0, s.err
+	}
+	id := s.nextID
+	s.nextID++
+	reply := make(chan sessionReply, 1)
+	s.pending[id] = reply
+	// a stalled clamd must not block the pending requests beyond their deadline
+	deadline, ok := ctx.Deadline()
+	if ok && deadline.After(s.readDeadline) {
+		s.readDeadline = deadline
+		s.conn.SetReadDeadline(deadline)
+	}
+	s.mu.Unlock()
+
+	// without a deadline the zero value disables the write deadline
+	s.conn.SetWriteDeadline(deadline)
+
+	if _, err = s.conn.Write([]byte(command)); err != nil {
+		err = fmt.Errorf("%w: failed to write command", err)
+	} else if payload != nil {
+		written, err = writeStream(s.conn, payload)
+	}
+
+	var sourceErr *SourceError
+	if errors.As(err, &sourceErr) {
+		// the payload could not be read, e.g. because it exceeds the size limit. The stream is
+		// terminated to keep the session usable, the reply stays pending and is discarded.
+		if _, writeErr := s.conn.Write(DELIM); writeErr == nil {
+			return nil, written, err
+		}
+	}
+	if err != nil {
+		// the session is in an undefined state and cannot be used anymore
+		s.fail(err)
+		return nil, written, err
+	}
+	return reply, written, nil
+}
+
+func (s *session) readLoop() {
+	reader := bufio.NewReader(s.conn)
+	for {
+		line, err := reader.ReadString('\000')
+		if err != nil {
+			if err == io.EOF {
+				err = ErrSessionClosed
+			}
+			s.fail(fmt.Errorf("%w: failed to read response", err))
+			return
+		}
+
+		id, data, err := parseSessionReply(line)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		s.mu.Lock()
+		if ch, ok := s.pending[id]; ok {
+			ch <- sessionReply{data: data}
+			delete(s.pending, id)
+		} else {
+			s.log.Debug("discarding reply of unknown request", "id", id)
+		}
+		if len(s.pending) == 0 {
+			s.readDeadline = time.Time{}
+			s.conn.SetReadDeadline(s.readDeadline)
+			s.lastUsed = time.Now()
+		}
+		done := s.closing && len(s.pending) == 0
+		s.mu.Unlock()
+		if done {
+			s.end()
+			return
+		}
+	}
+}
+
+// fail marks the session as broken and returns the error to all pending requests
+func (s *session) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	for id, ch := range s.pending {
+		ch <- sessionReply{err: err}
+		delete(s.pending, id)
+	}
+	s.conn.Close()
+}
+
+// closeWhenDone ends the session once all pending requests received their reply
+func (s *session) closeWhenDone() {
+	s.mu.Lock()
+	s.closing = true
+	done := s.err == nil && len(s.pending) == 0
+	s.mu.Unlock()
+	if done {
+		s.end()
+	}
+}
+
+func (s *session) end() {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	s.conn.Write([]byte("zEND\000"))
+	s.fail(ErrSessionClosed)
+}
+
+// parseSessionReply splits a reply in the form '<id>: <data>'
+func parseSessionReply(line string) (id int, data string, err error) {
+	line = strings.TrimRight(line, "\000")
+	idx := strings.Index(line, ": ")
+	if idx < 0 {
+		return 0, "", &MalformedReplyError{Reply: line}
+	}
+	id, err = strconv.Atoi(line[:idx])
+	if err != nil {
+		return 0, "", &MalformedReplyError{Reply: line}
+	}
+	return id, line[idx+2:], nil
+}
@@ -0,0 +1,202 @@
+package clamav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	ErrEmptyReply        = errors.New("clamav returned an empty reply")
+	ErrUnknownCommand    = errors.New("clamav does not support the command")
+	ErrSizeLimitExceeded = errors.New("size limit exceeded")
+)
+
+// ReplyError is returned if clamav replied with '<name>: <message> ERROR'
+type ReplyError struct {
+	Name    string
+	Message string
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("clamav returned an error: %s", e.Message)
+}
+
+func (e *ReplyError) Is(target error) bool {
+	return target == ErrSizeLimitExceeded && strings.Contains(e.Message, "size limit exceeded")
+}
+
+// MalformedReplyError is returned if the reply of clamav does not match the expected grammar
+type MalformedReplyError struct {
+	Reply string
+}
+
+func (e *MalformedReplyError) Error() string {
+	return fmt.Sprintf("clamav returned a malformed reply: %q", e.Reply)
+}
+
+// Reply is a single line of a SCAN or INSTREAM reply
+type Reply struct {
+	Name      string
+	Verdict   Verdict
+	Signature string
+}
+
+// ParseReply parses a single line of a SCAN or INSTREAM reply. The grammar is
+//
+//	<name>: OK
+//	<name>: <signature> FOUND
+//	<name>: <message> ERROR
+//
+// Errors of clamav are returned as *ReplyError.
+func ParseReply(line string) (*Reply, error) {
+	line = strings.TrimSpace(strings.Trim(line, "\000"))
+	if line == "" {
+		return nil, ErrEmptyReply
+	}
+	if line == "UNKNOWN COMMAND" {
+		return nil, ErrUnknownCommand
+	}
+
+	var name, status string
+	if idx := strings.LastIndex(line, ": "); idx >= 0 {
+		name, status = line[:idx], line[idx+2:]
+	} else {
+		status = line
+	}
+
+	switch {
+	case status == "OK" && name != "":
+		return &Reply{Name: name, Verdict: VerdictClean}, nil
+
+	case strings.HasSuffix(status, " FOUND") && name != "":
+		sig := strings.TrimSpace(strings.TrimSuffix(status, " FOUND"))
+		if sig == "" {
+			return nil, &MalformedReplyError{Reply: line}
+		}
+		return &Reply{Name: name, Verdict: VerdictInfected, Signature: sig}, nil
+
+	case strings.HasSuffix(status, "ERROR"):
+		msg := strings.TrimSpace(strings.TrimSuffix(status, "ERROR"))
+		return nil, &ReplyError{Name: name, Message: strings.TrimSuffix(msg, ".")}
+	}
+	return nil, &MalformedReplyError{Reply: line}
+}
+
+// ParseScanReply parses the complete reply of a SCAN or INSTREAM command.
+// With 'AllMatch' enabled clamav may reply with multiple lines.
+func ParseScanReply(raw string) (verdict Verdict, signatures []string, err error) {
+	lines := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == '\000' || r == '\n'
+	})
+	if len(lines) == 0 {
+		return VerdictError, nil, ErrEmptyReply
+	}
+
+	verdict = VerdictClean
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		reply, err := ParseReply(line)
+		if err != nil {
+			return VerdictError, nil, err
+		}
+		if reply.Verdict == VerdictInfected {
+			verdict = VerdictInfected
+			signatures = append(signatures, reply.Signature)
+		}
+	}
+	return verdict, signatures, nil
+}
+
+// Command is a command of the clamd protocol as it is read by a server
+type Command struct {
+	// Name is the command without its 'z' or 'n' prefix, e.g. 'INSTREAM'
+	Name string
+	// Delimiter terminates the command and its reply. It is '\000' for 'z' commands and '\n' otherwise.
+	Delimiter byte
+}
+
+// ReadCommand reads a command of the form 'zCOMMAND\000', 'nCOMMAND\n' or the deprecated 'COMMAND\n'.
+// Like clamd, deprecated commands may also be terminated by '\000'. They are replied with '\n'.
+func ReadCommand(r *bufio.Reader) (*Command, error) {
+	prefix, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var line []byte
+	cmd := &Command{Delimiter: '\n'}
+	switch prefix[0] {
+	case 'z':
+		cmd.Delimiter = '\000'
+		fallthrough
+	case 'n':
+		r.ReadByte()
+		if line, err = r.ReadSlice(cmd.Delimiter); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	default:
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			if b == '\n' || b == '\000' {
+				break
+			}
+			line = append(line, b)
+		}
+	}
+	cmd.Name = strings.TrimRight(string(line), "\r\n\000")
+	return cmd, nil
+}
+
+// StreamReader reads the chunks of an INSTREAM command. It returns io.EOF after the terminating zero-length chunk.
+type StreamReader struct {
+	r   io.Reader
+	n   uint32
+	eof bool
+}
+
+func NewStreamReader(r io.Reader) *StreamReader {
+	return &StreamReader{r: r}
+}
+
+func (s *StreamReader) Read(p []byte) (int, error) {
+	if s.eof {
+		return 0, io.EOF
+	}
+	if s.n == 0 {
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(s.r, size); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if s.n = binary.BigEndian.Uint32(size); s.n == 0 {
+			s.eof = true
+			return 0, io.EOF
+		}
+	}
+	if uint32(len(p)) > s.n {
+		p = p[:s.n]
+	}
+	n, err := s.r.Read(p)
+	s.n -= uint32(n)
+	return n, unexpectedEOF(err)
+}
+
+// Complete returns whether the terminating chunk was read
+func (s *StreamReader) Complete() bool {
+	return s.eof
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,286 @@
+package clamav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clamav_facade",
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breaker per clamd backend (0 = closed, 1 = open, 2 = half-open)",
+	}, []string{"backend"})
+)
+
+// CircuitOpenError is returned while the circuit breaker rejects requests
+type CircuitOpenError struct {
+	Backend    string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("clamav is unavailable: %s, retry after %s", ErrCircuitOpen, e.RetryAfter.Round(time.Second))
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// RetryPolicy configures the retries of idempotent calls to clamd
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts including the first one
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomizes the backoff by the given fraction, e.g. 0.2 = +/-20%
+	Jitter float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	backoff += backoff * p.Jitter * (rand.Float64()*2 - 1)
+	return time.Duration(backoff)
+}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type BreakerOptions struct {
+	// Threshold is the number of consecutive failures after which the breaker opens.
+	// A threshold of 0 disables the breaker.
+	Threshold int
+	// Cooldown is the duration the breaker stays open before a request is let through
+	Cooldown time.Duration
+}
+
+var DefaultBreakerOptions = BreakerOptions{
+	Threshold: 5,
+	Cooldown:  30 * time.Second,
+}
+
+// CircuitBreaker stops sending requests to clamd while it is unavailable
+type CircuitBreaker struct {
+	name     string
+	opts     BreakerOptions
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewCircuitBreaker(name string, opts BreakerOptions) *CircuitBreaker {
+	b := &CircuitBreaker{
+		name: name,
+		opts: opts,
+	}
+	breakerState.WithLabelValues(name).Set(float64(BreakerClosed))
+	return b
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow returns a *CircuitOpenError if the request must not be sent
+func (b *CircuitBreaker) Allow() error {
+	if b == nil || b.opts.Threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		elapsed := time.Since(b.openedAt)
+		if elapsed < b.opts.Cooldown {
+			return &CircuitOpenError{Backend: b.name, RetryAfter: b.opts.Cooldown - elapsed}
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return nil
+
+	case BreakerHalfOpen:
+		// only a single probe is let through until it succeeded
+		if b.probing {
+			return &CircuitOpenError{Backend: b.name, RetryAfter: time.Second}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Record updates the breaker with the outcome of a request
+func (b *CircuitBreaker) Record(failed bool) {
+	if b == nil || b.opts.Threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.setState(BreakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.opts.Threshold {
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// Release lets the next request probe a half-open breaker without recording an outcome.
+// It is used if nothing is known about clamd, e.g. because the caller cancelled the request.
+func (b *CircuitBreaker) Release() {
+	if b == nil || b.opts.Threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	breakerState.WithLabelValues(b.name).Set(float64(state))
+}
+
+// isTransient reports whether err was caused by an unavailable clamd
+func isTransient(err error) bool {
+	var sourceErr *SourceError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &sourceErr), errors.Is(err, context.Canceled):
+		return false
+	case errors.As(err, &netErr),
+		errors.Is(err, ErrEmptyReply),
+		errors.Is(err, ErrNotReady),
+		errors.Is(err, ErrSessionClosed),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	}
+	return false
+}
+
+// call executes fn with the circuit breaker and retry policy of the client.
+// If obj is not nil, fn is only retried if obj can be rewound.
+func (c *ClamavClient) call(ctx context.Context, obj io.Reader, fn func() error) (err error) {
+	attempts := c.Retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var rewind func() error
+	if obj != nil {
+		attempts = 1
+		if seeker, ok := obj.(io.Seeker); ok && c.Retry.MaxAttempts > 1 {
+			if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+				attempts = c.Retry.MaxAttempts
+				rewind = func() error {
+					_, err := seeker.Seek(offset, io.SeekStart)
+					return err
+				}
+			}
+		}
+	}
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			backoff := c.Retry.backoff(attempt - 1)
+			c.Log.Warn("retrying failed request", "attempt", attempt+1, "backoff", backoff, "error", err)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff):
+			}
+			if rewind != nil {
+				if rewindErr := rewind(); rewindErr != nil {
+					return err
+				}
+			}
+		}
+
+		if openErr := c.breaker.Allow(); openErr != nil {
+			return openErr
+		}
+		err = fn()
+		transient := err != nil && isTransient(err)
+		var replyErr *ReplyError
+		switch {
+		case err == nil, errors.As(err, &replyErr):
+			c.breaker.Record(false)
+		case ctx.Err() != nil, errors.Is(err, context.Canceled):
+			// the caller gave up before clamd answered. Timeouts of clamd itself are transient failures.
+			c.breaker.Release()
+			return err
+		case transient:
+			c.breaker.Record(true)
+		default:
+			// e.g. the object could not be read, clamd did not answer either
+			c.breaker.Release()
+		}
+		if !transient {
+			return err
+		}
+	}
+	return err
+}
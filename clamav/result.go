@@ -0,0 +1,50 @@
+package clamav
+
+import (
+	"strings"
+	"time"
+)
+
+type Verdict string
+
+const (
+	VerdictClean    Verdict = "clean"
+	VerdictInfected Verdict = "infected"
+	VerdictError    Verdict = "error"
+)
+
+// ScanResult is the outcome of a single INSTREAM scan
+type ScanResult struct {
+	Verdict    Verdict       `json:"verdict"`
+	Signatures []string      `json:"signatures,omitempty"`
+	Raw        string        `json:"raw"`
+	Size       int64         `json:"size"`
+	Elapsed    time.Duration `json:"elapsed"`
+	// Version is the version of clamd which scanned the object. It is only set if the client requests it with ScanVersion.
+	Version *VersionInfo `json:"version,omitempty"`
+}
+
+func (r *ScanResult) Clean() bool {
+	return r.Verdict == VerdictClean
+}
+
+func (r *ScanResult) Infected() bool {
+	return r.Verdict == VerdictInfected
+}
+
+// Signature returns all detected signatures as a single string
+func (r *ScanResult) Signature() string {
+	return strings.Join(r.Signatures, ", ")
+}
+
+// newScanResult evaluates the raw reply of clamav. If clamav replied with an error,
+// the result is returned alongside the error.
+func newScanResult(raw string, size int64, elapsed time.Duration) (res *ScanResult, err error) {
+	res = &ScanResult{
+		Raw:     raw,
+		Size:    size,
+		Elapsed: elapsed,
+	}
+	res.Verdict, res.Signatures, err = ParseScanReply(raw)
+	return res, err
+}
@@ -0,0 +1,143 @@
+package clamav
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Stats is the parsed reply of the STATS command
+type Stats struct {
+	Pools   int         `json:"pools"`
+	State   string      `json:"state"`
+	Threads ThreadStats `json:"threads"`
+	Queue   int         `json:"queue"`
+	Memory  MemStats    `json:"memstats"`
+	Raw     string      `json:"-"`
+}
+
+type ThreadStats struct {
+	Live        int `json:"live"`
+	Idle        int `json:"idle"`
+	Max         int `json:"max"`
+	IdleTimeout int `json:"idle_timeout"`
+}
+
+// MemStats contains the memory usage of clamd in megabytes.
+// Values which are not available on the platform of clamd are nil.
+type MemStats struct {
+	Heap       *float64 `json:"heap"`
+	Mmap       *float64 `json:"mmap"`
+	Used       *float64 `json:"used"`
+	Free       *float64 `json:"free"`
+	Releasable *float64 `json:"releasable"`
+	Pools      int      `json:"pools"`
+	PoolsUsed  *float64 `json:"pools_used"`
+	PoolsTotal *float64 `json:"pools_total"`
+}
+
+// ParseStats parses the reply of the STATS command, e.g.
+//
+//	POOLS: 1
+//
+//	STATE: VALID PRIMARY
+//	THREADS: live 1  idle 0 max 10 idle-timeout 30
+//	QUEUE: 0 items
+//		STATS 0.000064
+//
+//	MEMSTATS: heap N/A mmap N/A used N/A free N/A releasable N/A pools 1 pools_used 1280.741M pools_total 1280.788M
+//	END
+func ParseStats(raw string) (stats *Stats, err error) {
+	stats = &Stats{Raw: raw}
+	var terminated bool
+
+	for _, line := range strings.Split(trimReply(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "END" {
+			terminated = true
+			break
+		}
+		idx := strings.Index(line, ": ")
+		if idx < 0 {
+			// empty lines and the tasks of the queue
+			continue
+		}
+		key, value := line[:idx], strings.TrimSpace(line[idx+2:])
+
+		switch key {
+		case "POOLS":
+			stats.Pools, err = strconv.Atoi(value)
+		case "STATE":
+			stats.State = value
+		case "THREADS":
+			err = parseStatsPairs(value, func(key, value string) (err error) {
+				switch key {
+				case "live":
+					stats.Threads.Live, err = strconv.Atoi(value)
+				case "idle":
+					stats.Threads.Idle, err = strconv.Atoi(value)
+				case "max":
+					stats.Threads.Max, err = strconv.Atoi(value)
+				case "idle-timeout":
+					stats.Threads.IdleTimeout, err = strconv.Atoi(value)
+				}
+				return
+			})
+		case "QUEUE":
+			stats.Queue, err = strconv.Atoi(strings.TrimSuffix(value, " items"))
+		case "MEMSTATS":
+			mem := &stats.Memory
+			err = parseStatsPairs(value, func(key, value string) (err error) {
+				switch key {
+				case "heap":
+					mem.Heap, err = parseMegabytes(value)
+				case "mmap":
+					mem.Mmap, err = parseMegabytes(value)
+				case "used":
+					mem.Used, err = parseMegabytes(value)
+				case "free":
+					mem.Free, err = parseMegabytes(value)
+				case "releasable":
+					mem.Releasable, err = parseMegabytes(value)
+				case "pools":
+					mem.Pools, err = strconv.Atoi(value)
+				case "pools_used":
+					mem.PoolsUsed, err = parseMegabytes(value)
+				case "pools_total":
+					mem.PoolsTotal, err = parseMegabytes(value)
+				}
+				return
+			})
+		}
+		if err != nil {
+			return nil, &MalformedReplyError{Reply: line}
+		}
+	}
+
+	if !terminated {
+		return nil, &MalformedReplyError{Reply: raw}
+	}
+	return stats, nil
+}
+
+// parseStatsPairs calls fn for each pair of the form '<key> <value> <key> <value> ...'
+func parseStatsPairs(s string, fn func(key, value string) error) error {
+	fields := strings.Fields(s)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if err := fn(fields[i], fields[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMegabytes parses values like '12.345M'. 'N/A' is returned as nil.
+func parseMegabytes(s string) (*float64, error) {
+	if s == "N/A" {
+		return nil, nil
+	}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "M"), 64)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
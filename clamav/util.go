@@ -1,38 +1,43 @@
 package clamav
 
 import (
-	"bytes"
+	"errors"
 	"io"
-	"io/ioutil"
-	"net/http"
-	"net/url"
 )
 
-func download(rawURL string) (n int, obj io.Reader, err error) {
-	var resp *http.Response
-	var body []byte
+var ErrFileTooLarge = errors.New("file size limit exceeded")
 
-	uri, err := url.Parse(rawURL)
-	if err != nil {
-		return 0, nil, err
-	}
+// LimitReader returns a reader which fails with ErrFileTooLarge
+// once more than max bytes are read
+func LimitReader(r io.Reader, max int) io.Reader {
+	return &limitReader{r: r, max: max}
+}
 
-	resp, err = http.DefaultClient.Get(uri.String())
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
-	body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
+type limitReader struct {
+	r   io.Reader
+	n   int
+	max int
+}
+
+func (l *limitReader) Read(p []byte) (n int, err error) {
+	n, err = l.r.Read(p)
+	l.n += n
+	if l.n > l.max {
+		return 0, ErrFileTooLarge
 	}
-	return len(body), bytes.NewReader(body), nil
+	return n, err
 }
 
-func readFile(rawURL string) (n int, obj io.Reader, err error) {
-	body, err := ioutil.ReadFile(rawURL)
-	if err != nil {
-		return 0, nil, err
+// Seek is delegated to the underlying reader so that retries can rewind it.
+// It fails if the underlying reader does not implement io.Seeker.
+func (l *limitReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := l.r.(io.Seeker)
+	if !ok {
+		return 0, errors.New("seek is not supported")
+	}
+	pos, err := seeker.Seek(offset, whence)
+	if err == nil {
+		l.n = int(pos)
 	}
-	return len(body), bytes.NewReader(body), nil
+	return pos, err
 }
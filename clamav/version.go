@@ -0,0 +1,46 @@
+package clamav
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VersionInfo is the parsed reply of the VERSION command
+type VersionInfo struct {
+	// Engine is the version of clamav, e.g. '1.0.1'
+	Engine string `json:"engine"`
+	// Database is the version of the signature database, e.g. 26820
+	Database int `json:"database,omitempty"`
+	// DatabaseTime is the build time of the signature database
+	DatabaseTime time.Time `json:"database_time,omitempty"`
+	Raw          string    `json:"raw"`
+}
+
+// ParseVersion parses the reply of the VERSION command, e.g. 'ClamAV 1.0.1/26820/Tue Feb 28 08:24:21 2023'.
+// If clamd has not loaded a database, only the engine version is returned.
+func ParseVersion(raw string) (*VersionInfo, error) {
+	raw = trimReply(raw)
+	if raw == "" {
+		return nil, ErrEmptyReply
+	}
+	if !strings.HasPrefix(raw, "ClamAV ") {
+		return nil, &MalformedReplyError{Reply: raw}
+	}
+
+	info := &VersionInfo{Raw: raw}
+	parts := strings.SplitN(strings.TrimPrefix(raw, "ClamAV "), "/", 3)
+	info.Engine = parts[0]
+	if len(parts) == 3 {
+		var err error
+		if info.Database, err = strconv.Atoi(parts[1]); err != nil {
+			return nil, &MalformedReplyError{Reply: raw}
+		}
+		if info.DatabaseTime, err = time.Parse(time.ANSIC, parts[2]); err != nil {
+			return nil, &MalformedReplyError{Reply: raw}
+		}
+	} else if len(parts) != 1 {
+		return nil, &MalformedReplyError{Reply: raw}
+	}
+	return info, nil
+}
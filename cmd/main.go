@@ -2,16 +2,31 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
 	"time"
 
 	"github.com/ron96G/clamav-facade/api"
+	"github.com/ron96G/clamav-facade/archive"
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/clamav-facade/fetch"
+	"github.com/ron96G/clamav-facade/oci"
 	log "github.com/ron96G/go-common-utils/log"
 )
 
 var (
-	file     = flag.String("file", "", "the file which will be scanned")
+	file     = flag.String("file", "", "the file which will be scanned. Either a path or an url with the scheme file://, http(s)://, data: or s3://")
+	expand   = flag.Bool("expand", false, "scan each entry of the zip, tar or gzip archive of --file separately")
+	image    = flag.String("image", "", "the tarball of 'docker save' or of an OCI image layout which will be scanned. A JSON report is printed. The exit code is 1 if a file is infected or could not be scanned")
+	imageOut = flag.String("image.report", "", "the file to which the JSON report of --image is written. Empty writes it to stdout together with the logs")
+	scanDir  = flag.String("path", "", "the file or directory which will be scanned recursively. A summary is logged. The exit code is 1 if a file is infected or could not be scanned")
+	include  = flag.String("path.include", "", "comma-separated globs of the files which are scanned with --path, e.g. '*.exe,bin/*'. A glob matches the relative path or the name of a file. Empty includes all files")
+	exclude  = flag.String("path.exclude", "", "comma-separated globs of the files and directories which are skipped with --path")
+	symlinks = flag.Bool("path.followsymlinks", false, "scan the targets of symbolic links with --path")
+	maxDepth = flag.Int("path.maxdepth", 0, "maximum depth of the files which are scanned with --path. 1 only scans the files of the directory. 0 disables the limit")
+	workers  = flag.Int("path.workers", 4, "number of files which are scanned concurrently with --path")
 	reload   = flag.Bool("reload", false, "reload clamd")
 	ping     = flag.Bool("ping", true, "ping clamd")
 	stats    = flag.Bool("stats", false, "get stats about the scan queue")
@@ -19,7 +34,15 @@ var (
 	shutdown = flag.Bool("shutdown", false, "shutdown clamd")
 )
 
-func Run(client api.Client, logger log.Logger) {
+// Config is the configuration of the commands which is shared with the servers
+type Config struct {
+	// Fetchers provides the file of --expand
+	Fetchers *fetch.Registry
+	// Limits stop the expansion of archives which would exhaust the resources
+	Limits archive.Limits
+}
+
+func Run(client api.Client, cfg Config, logger log.Logger) {
 	ctx := context.Background()
 
 	if *ping {
@@ -36,7 +59,7 @@ func Run(client api.Client, logger log.Logger) {
 			logger.Error("failed to get version of clamav", "error", err)
 			os.Exit(1)
 		}
-		logger.Info(version)
+		logger.Info(version.Raw, "engine", version.Engine, "database", version.Database, "database_time", version.DatabaseTime)
 	}
 
 	if *stats {
@@ -45,7 +68,7 @@ func Run(client api.Client, logger log.Logger) {
 			logger.Error("failed to get stats of clamav", "error", err)
 			os.Exit(1)
 		}
-		logger.Info(stats)
+		logger.Info(stats.Raw)
 	}
 
 	if *reload {
@@ -56,28 +79,138 @@ func Run(client api.Client, logger log.Logger) {
 		}
 	}
 
-	if *file != "" {
-		var ok bool
+	if *file != "" && *expand {
+		start := time.Now()
+		logger.Info("scanning archive", "file", *file)
+
+		infected, err := scanArchive(ctx, client, cfg, *file, logger)
+		if err != nil {
+			logger.Error("failed to scan archive", "error", err, "elapsed_time", time.Since(start))
+			os.Exit(1)
+		}
+		if infected > 0 {
+			logger.Warn("virus found", "file", *file, "infected_entries", infected, "elapsed_time", time.Since(start))
+			os.Exit(1)
+		}
+		logger.Info("successfully scanned archive", "file", *file, "elapsed_time", time.Since(start))
+	} else if *file != "" {
+		var res *clamav.ScanResult
 		var err error
 		start := time.Now()
 
 		logger.Info("scanning file", "file", *file)
 
-		ok, err = client.ScanFile(ctx, *file)
+		res, err = client.ScanFile(ctx, *file)
 		if err != nil {
 			logger.Error("failed to scan file", "error", err, "elapsed_time", time.Since(start))
 			os.Exit(1)
 		}
 
-		if !ok {
-			logger.Warn("virus found", "file", *file, "elapsed_time", time.Since(start))
+		if !res.Clean() {
+			logger.Warn("virus found", "file", *file, "signatures", res.Signatures, "response", res.Raw, "elapsed_time", time.Since(start))
 			os.Exit(1)
 		}
 		logger.Info("successfully scanned file", "file", *file, "elapsed_time", time.Since(start))
 	}
 
+	if *scanDir != "" {
+		start := time.Now()
+		logger.Info("scanning path", "path", *scanDir)
+
+		summary, err := ScanPath(ctx, client, *scanDir, WalkOptions{
+			Include:        splitList(*include),
+			Exclude:        splitList(*exclude),
+			FollowSymlinks: *symlinks,
+			MaxDepth:       *maxDepth,
+			Workers:        *workers,
+		}, logger)
+		logger.Info("scan summary", "path", *scanDir, "files", summary.Files, "clean", summary.Clean, "infected", summary.Infected,
+			"failed", summary.Failed, "scanned_bytes", summary.Bytes, "elapsed_time", time.Since(start))
+		if err != nil {
+			logger.Error("failed to scan path", "error", err)
+			os.Exit(1)
+		}
+		if summary.Infected > 0 || summary.Failed > 0 {
+			os.Exit(1)
+		}
+	}
+
+	if *image != "" {
+		start := time.Now()
+		logger.Info("scanning image", "image", *image)
+
+		report, err := scanImage(ctx, client, *image)
+		if report != nil {
+			if err := writeReport(*imageOut, report); err != nil {
+				logger.Error("failed to write report", "error", err)
+				os.Exit(1)
+			}
+		}
+		if err != nil {
+			logger.Error("failed to scan image", "error", err, "elapsed_time", time.Since(start))
+			os.Exit(1)
+		}
+		if report.Failed() {
+			logger.Warn("image is not clean", "image", *image, "findings", len(report.Findings), "failures", len(report.Failures), "elapsed_time", time.Since(start))
+			os.Exit(1)
+		}
+		logger.Info("successfully scanned image", "image", *image, "files", report.Scanned, "elapsed_time", time.Since(start))
+	}
+
 	if *shutdown {
 		client.Shutdown(ctx)
 	}
 
 }
+
+// scanArchive scans each entry of the archive at rawURL and returns the number of infected entries
+func scanArchive(ctx context.Context, client api.Client, cfg Config, rawURL string, logger log.Logger) (infected int, err error) {
+	fetchers := cfg.Fetchers
+	if fetchers == nil {
+		fetchers = fetch.DefaultRegistry
+	}
+	obj, err := fetchers.Fetch(ctx, rawURL)
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Body.Close()
+
+	err = archive.Walk(obj.Body, cfg.Limits, func(entry *archive.Entry) error {
+		res, err := client.Scan(ctx, clamav.LimitReader(entry.Body, client.MaxFilesize()))
+		if err != nil {
+			return fmt.Errorf("failed to scan %s: %w", entry.Path, err)
+		}
+		if !res.Clean() {
+			infected++
+			logger.Warn("virus found", "file", rawURL, "path", entry.Path, "signatures", res.Signatures)
+		}
+		return nil
+	})
+	return infected, err
+}
+
+// scanImage scans the files of the image tarball at filename
+func scanImage(ctx context.Context, client api.Client, filename string) (*oci.Report, error) {
+	img, err := oci.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	return img.Scan(ctx, client)
+}
+
+// writeReport writes the report as JSON to filename or to stdout if filename is empty
+func writeReport(filename string, report interface{}) error {
+	w := os.Stdout
+	if filename != "" {
+		f, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ron96G/clamav-facade/api"
+	"github.com/ron96G/clamav-facade/clamav"
+	log "github.com/ron96G/go-common-utils/log"
+)
+
+// WalkOptions configure the recursive scan of a directory
+type WalkOptions struct {
+	// Include are the globs of the files which are scanned. Empty includes all files.
+	// A glob matches either the path relative to the root or the name of a file, e.g. '*.exe' or 'bin/*'.
+	Include []string
+	// Exclude are the globs of the files and directories which are skipped
+	Exclude []string
+	// FollowSymlinks scans the targets of symbolic links. Loops are detected.
+	FollowSymlinks bool
+	// MaxDepth is the maximum depth of the scanned files. 1 only scans the files of the root. 0 disables the limit.
+	MaxDepth int
+	// Workers is the number of files which are scanned concurrently
+	Workers int
+}
+
+// Summary counts the files of a recursive scan by their outcome
+type Summary struct {
+	Files    int64
+	Clean    int64
+	Infected int64
+	Failed   int64
+	Bytes    int64
+}
+
+// ScanPath scans the file or every file of the directory at root concurrently.
+// Infected and failed files are logged, the returned summary counts all files.
+func ScanPath(ctx context.Context, client api.Client, root string, opts WalkOptions, logger log.Logger) (*Summary, error) {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	summary := &Summary{}
+	files := make(chan string, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range files {
+				scanPathFile(ctx, client, name, summary, logger)
+			}
+		}()
+	}
+
+	w := &walker{opts: opts, files: files, logger: logger, ctx: ctx}
+	err := w.walk(root, "", 0, nil)
+	close(files)
+	wg.Wait()
+	return summary, err
+}
+
+func scanPathFile(ctx context.Context, client api.Client, name string, summary *Summary, logger log.Logger) {
+	atomic.AddInt64(&summary.Files, 1)
+	f, err := os.Open(name)
+	if err != nil {
+		atomic.AddInt64(&summary.Failed, 1)
+		logger.Warn("failed to open file", "file", name, "error", err)
+		return
+	}
+	defer f.Close()
+
+	res, err := client.Scan(ctx, clamav.LimitReader(f, client.MaxFilesize()))
+	switch {
+	case err != nil:
+		atomic.AddInt64(&summary.Failed, 1)
+		logger.Warn("failed to scan file", "file", name, "error", err)
+	case !res.Clean():
+		atomic.AddInt64(&summary.Infected, 1)
+		atomic.AddInt64(&summary.Bytes, res.Size)
+		logger.Warn("virus found", "file", name, "signatures", res.Signatures)
+	default:
+		atomic.AddInt64(&summary.Clean, 1)
+		atomic.AddInt64(&summary.Bytes, res.Size)
+		logger.Debug("scanned file", "file", name)
+	}
+}
+
+type walker struct {
+	opts   WalkOptions
+	files  chan<- string
+	logger log.Logger
+	ctx    context.Context
+}
+
+// walk sends the files below name to the workers. rel is the slash-separated path relative to the root
+// and depth is the number of its elements. parents are the directories above name, they are used
+// to detect loops of symbolic links.
+func (w *walker) walk(name, rel string, depth int, parents []os.FileInfo) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(name)
+	if err != nil {
+		if rel == "" {
+			return err
+		}
+		w.logger.Warn("skipping file", "file", name, "error", err)
+		return nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !w.opts.FollowSymlinks && rel != "" {
+			return nil
+		}
+		if info, err = os.Stat(name); err != nil {
+			w.logger.Warn("skipping broken symbolic link", "file", name, "error", err)
+			return nil
+		}
+	}
+
+	if rel != "" && matchAny(w.opts.Exclude, rel) {
+		return nil
+	}
+
+	if !info.IsDir() {
+		if w.opts.MaxDepth > 0 && depth > w.opts.MaxDepth {
+			return nil
+		}
+		if info.Mode().IsRegular() && (len(w.opts.Include) == 0 || rel == "" || matchAny(w.opts.Include, rel)) {
+			select {
+			case w.files <- name:
+			case <-w.ctx.Done():
+				return w.ctx.Err()
+			}
+		}
+		return nil
+	}
+
+	if w.opts.MaxDepth > 0 && depth >= w.opts.MaxDepth {
+		return nil
+	}
+	for _, parent := range parents {
+		if os.SameFile(parent, info) {
+			w.logger.Warn("skipping loop of symbolic links", "file", name)
+			return nil
+		}
+	}
+
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		if rel == "" {
+			return err
+		}
+		// unreadable directories are skipped like clamscan does
+		w.logger.Warn("failed to read directory", "dir", name, "error", err)
+		return nil
+	}
+	parents = append(parents, info)
+	for _, entry := range entries {
+		if err := w.walk(filepath.Join(name, entry.Name()), path.Join(rel, entry.Name()), depth+1, parents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchAny returns whether a glob matches the relative path or the name of a file
+func matchAny(globs []string, rel string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(glob, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
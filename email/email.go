@@ -0,0 +1,160 @@
+package email
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// MaxDepth is the maximum nesting of multipart bodies and message/rfc822 parts
+const MaxDepth = 16
+
+var ErrTooDeep = errors.New("message is nested too deeply")
+
+// Part is a leaf part of a message, e.g. the text or an attachment
+type Part struct {
+	// Path is the position of the part in the message, e.g. '2.1' for the first part of the second part
+	Path string
+	// Filename is the name of the attachment. It is empty for inline parts without name.
+	Filename    string
+	ContentType string
+	Disposition string
+	Header      textproto.MIMEHeader
+	// Body is the content with the transfer encoding removed
+	Body io.Reader
+}
+
+// IsAttachment returns whether the part is an attachment rather than the text of the message
+func (p *Part) IsAttachment() bool {
+	return p.Disposition == "attachment" || p.Filename != ""
+}
+
+// Walk calls fn for every leaf part of the RFC 5322 message in r. Multipart bodies and
+// message/rfc822 parts are descended. Base64 and quoted-printable bodies are decoded.
+// The body of a part is only valid until fn returns.
+func Walk(r io.Reader, fn func(*Part) error) error {
+	br := bufio.NewReader(r)
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && !(err == io.EOF && len(header) > 0) {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	return walk(header, br, "", 0, fn)
+}
+
+func walk(header textproto.MIMEHeader, body io.Reader, path string, depth int, fn func(*Part) error) error {
+	if depth > MaxDepth {
+		return ErrTooDeep
+	}
+
+	contentType := header.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		reader := multipart.NewReader(body, params["boundary"])
+		for i := 1; ; i++ {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read part %s: %w", childPath(path, i), err)
+			}
+			err = walk(part.Header, part, childPath(path, i), depth+1, fn)
+			part.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+	case mediaType == "message/rfc822":
+		br := bufio.NewReader(decode(header, body))
+		nested, err := textproto.NewReader(br).ReadMIMEHeader()
+		if err != nil && !(err == io.EOF && len(nested) > 0) {
+			return fmt.Errorf("failed to read header of part %s: %w", path, err)
+		}
+		return walk(nested, br, path, depth+1, fn)
+	}
+
+	part := &Part{
+		Path:        path,
+		ContentType: mediaType,
+		Filename:    decodeWord(params["name"]),
+		Header:      header,
+		Body:        decode(header, body),
+	}
+	if part.Path == "" {
+		part.Path = "1"
+	}
+	if disposition, dispParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.Disposition = disposition
+		if dispParams["filename"] != "" {
+			part.Filename = decodeWord(dispParams["filename"])
+		}
+	}
+
+	if err := fn(part); err != nil {
+		return err
+	}
+	// the remaining body must be consumed to read the next part
+	_, err = io.Copy(io.Discard, part.Body)
+	return err
+}
+
+// decode removes the Content-Transfer-Encoding of body
+func decode(header textproto.MIMEHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// base64Cleaner removes characters which are not part of the base64 alphabet, e.g. whitespace
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	for {
+		n, err := c.r.Read(p)
+		j := 0
+		for _, b := range p[:n] {
+			if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '+' || b == '/' || b == '=' {
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+// decodeWord decodes RFC 2047 encoded words, e.g. '=?UTF-8?Q?r=C3=A9sum=C3=A9.pdf?='
+func decodeWord(s string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+func childPath(path string, i int) string {
+	if path == "" {
+		return fmt.Sprint(i)
+	}
+	return fmt.Sprintf("%s.%d", path, i)
+}
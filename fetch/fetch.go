@@ -0,0 +1,85 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fetcher returns the object of an url
+type Fetcher interface {
+	Fetch(ctx context.Context, u *url.URL) (*Object, error)
+}
+
+// Registry selects the Fetcher of an url by its scheme
+type Registry struct {
+	mu       sync.RWMutex
+	fetchers map[string]Fetcher
+}
+
+// DefaultRegistry contains the fetchers for file, http(s) and data urls.
+// The http fetcher is not restricted by a Guard.
+var DefaultRegistry = NewRegistry()
+
+func init() {
+	DefaultRegistry.Register("file", &FileFetcher{})
+	DefaultRegistry.Register("data", &DataFetcher{})
+	http := NewHTTPFetcher(nil, 5*time.Minute)
+	DefaultRegistry.Register("http", http)
+	DefaultRegistry.Register("https", http)
+}
+
+// NewRemoteRegistry returns a registry for untrusted urls. It contains the fetchers for http(s) urls,
+// which are restricted by guard, and data urls. Local files can not be fetched.
+func NewRemoteRegistry(guard *Guard, timeout time.Duration) *Registry {
+	r := NewRegistry()
+	http := NewHTTPFetcher(guard, timeout)
+	r.Register("http", http)
+	r.Register("https", http)
+	r.Register("data", &DataFetcher{})
+	return r
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		fetchers: map[string]Fetcher{},
+	}
+}
+
+// Register adds f for the scheme. An existing fetcher of the scheme is replaced.
+func (r *Registry) Register(scheme string, f Fetcher) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fetchers[strings.ToLower(scheme)] = f
+}
+
+func (r *Registry) Fetcher(scheme string) (Fetcher, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.fetchers[strings.ToLower(scheme)]
+	return f, ok
+}
+
+// Fetch returns the object of rawURL using the fetcher of its scheme.
+// Plain paths are fetched with the fetcher of the 'file' scheme.
+func (r *Registry) Fetch(ctx context.Context, rawURL string) (*Object, error) {
+	u := &url.URL{Scheme: "file", Path: rawURL}
+	if strings.Contains(rawURL, ":") {
+		var err error
+		if u, err = url.Parse(rawURL); err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" {
+			u = &url.URL{Scheme: "file", Path: rawURL}
+		}
+	}
+
+	f, ok := r.Fetcher(u.Scheme)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+	}
+	return f.Fetch(ctx, u)
+}
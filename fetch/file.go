@@ -0,0 +1,59 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileFetcher reads local files
+type FileFetcher struct{}
+
+func (f *FileFetcher) Fetch(ctx context.Context, u *url.URL) (*Object, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("file url must not contain a remote host %q", u.Host)
+	}
+	file, err := os.Open(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a regular file", u.Path)
+	}
+	return &Object{Name: filepath.Base(u.Path), Body: file, Size: info.Size()}, nil
+}
+
+// DataFetcher decodes data urls, e.g. 'data:text/plain;base64,SGVsbG8='
+type DataFetcher struct{}
+
+func (f *DataFetcher) Fetch(ctx context.Context, u *url.URL) (*Object, error) {
+	idx := strings.Index(u.Opaque, ",")
+	if idx < 0 {
+		return nil, fmt.Errorf("invalid data url: missing ','")
+	}
+	meta, data := u.Opaque[:idx], u.Opaque[idx+1:]
+
+	decoded, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid data url", err)
+	}
+	body := []byte(decoded)
+	if strings.HasSuffix(meta, ";base64") {
+		if body, err = base64.StdEncoding.DecodeString(decoded); err != nil {
+			return nil, fmt.Errorf("%w: invalid data url", err)
+		}
+	}
+	return &Object{Body: io.NopCloser(bytes.NewReader(body)), Size: int64(len(body))}, nil
+}
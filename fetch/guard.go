@@ -0,0 +1,205 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrForbidden         = errors.New("destination is not allowed")
+	ErrTooManyRedirects  = errors.New("too many redirects")
+	ErrUnsupportedScheme = errors.New("unsupported url scheme")
+
+	// internalCIDRs are internal networks which are not already private or link-local
+	internalCIDRs = mustParseCIDRs([]string{
+		"100.64.0.0/10",      // carrier-grade NAT (RFC 6598)
+		"fd00:ec2::254/128",  // AWS metadata service (IPv6)
+		"100.100.100.200/32", // Alibaba Cloud metadata service
+		// NAT64 translates these into arbitrary IPv4 addresses, e.g. 64:ff9b::a9fe:a9fe into 169.254.169.254
+		"64:ff9b::/96",   // well-known NAT64 prefix (RFC 6052)
+		"64:ff9b:1::/48", // local-use NAT64 prefix (RFC 8215)
+	})
+)
+
+// ForbiddenError is returned if a destination is rejected by the Guard
+type ForbiddenError struct {
+	Destination string
+	Reason      string
+}
+
+func (e *ForbiddenError) Error() string {
+	return fmt.Sprintf("%s: %s %s", ErrForbidden, e.Destination, e.Reason)
+}
+
+func (e *ForbiddenError) Is(target error) bool {
+	return target == ErrForbidden
+}
+
+// Guard restricts the destinations of outgoing requests.
+// Loopback, private (RFC 1918, RFC 4193), carrier-grade NAT, link-local, unspecified, multicast,
+// NAT64 and metadata addresses are always blocked unless they are explicitly part of AllowCIDRs.
+// IPv4-mapped IPv6 addresses are checked as their IPv4 address.
+type Guard struct {
+	// AllowHosts restricts requests to these hosts if it is not empty.
+	// Hosts starting with '*.' also match all subdomains.
+	AllowHosts []string
+	DenyHosts  []string
+	// AllowCIDRs restricts requests to these networks if it is not empty.
+	// The addresses are checked after DNS resolution.
+	AllowCIDRs []*net.IPNet
+	DenyCIDRs  []*net.IPNet
+	// MaxRedirects is the maximum number of redirects which are followed
+	MaxRedirects int
+}
+
+// CheckHost returns a *ForbiddenError if requests to host are not allowed
+func (g *Guard) CheckHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range g.DenyHosts {
+		if matchHost(host, pattern) {
+			return &ForbiddenError{Destination: host, Reason: "is denied"}
+		}
+	}
+	if len(g.AllowHosts) == 0 {
+		return nil
+	}
+	for _, pattern := range g.AllowHosts {
+		if matchHost(host, pattern) {
+			return nil
+		}
+	}
+	return &ForbiddenError{Destination: host, Reason: "is not allowed"}
+}
+
+// CheckIP returns a *ForbiddenError if connections to ip are not allowed
+func (g *Guard) CheckIP(ip net.IP) error {
+	if containsIP(g.DenyCIDRs, ip) {
+		return &ForbiddenError{Destination: ip.String(), Reason: "is denied"}
+	}
+	if containsIP(g.AllowCIDRs, ip) {
+		return nil
+	}
+	if len(g.AllowCIDRs) > 0 {
+		return &ForbiddenError{Destination: ip.String(), Reason: "is not allowed"}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || containsIP(internalCIDRs, ip) {
+		return &ForbiddenError{Destination: ip.String(), Reason: "is an internal address"}
+	}
+	return nil
+}
+
+// Transport returns a transport which only connects to allowed addresses.
+// Proxies are not used since they would bypass the checks.
+func (g *Guard) Transport(timeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return &ForbiddenError{Destination: host, Reason: "is not an ip address"}
+			}
+			return g.CheckIP(ip)
+		},
+	}
+	return &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// Client returns a http client which uses the transport of the guard and checks all redirects
+func (g *Guard) Client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: g.Transport(timeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > g.MaxRedirects {
+				return ErrTooManyRedirects
+			}
+			return g.checkURL(req.URL.Scheme, req.URL.Hostname())
+		},
+	}
+}
+
+func (g *Guard) checkURL(scheme, host string) error {
+	if scheme != "http" && scheme != "https" {
+		return fmt.Errorf("%w: %q", ErrUnsupportedScheme, scheme)
+	}
+	if g == nil {
+		return nil
+	}
+	return g.CheckHost(host)
+}
+
+// ParseCIDRs parses networks in CIDR notation. Single addresses are accepted as well.
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(list []string) []*net.IPNet {
+	nets, err := ParseCIDRs(list)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(host, pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
@@ -0,0 +1,84 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+// Object is a fetched object which can be streamed.
+// The caller must close Body.
+type Object struct {
+	Name string
+	Body io.ReadCloser
+	// Size is the declared size of the object. It is -1 if it is unknown.
+	Size int64
+}
+
+// StatusError is returned if the server replied with an unexpected status code
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed to fetch %s: unexpected status code %d", e.URL, e.StatusCode)
+}
+
+// HTTPFetcher fetches objects over http(s) within the restrictions of its Guard
+type HTTPFetcher struct {
+	// Guard restricts the destinations. If it is nil, all destinations are allowed.
+	Guard  *Guard
+	Client *http.Client
+	// Header is added to every request
+	Header http.Header
+	// BearerToken is sent in the Authorization header if it is not empty
+	BearerToken string
+}
+
+func NewHTTPFetcher(guard *Guard, timeout time.Duration) *HTTPFetcher {
+	client := &http.Client{Timeout: timeout}
+	if guard != nil {
+		client = guard.Client(timeout)
+	}
+	return &HTTPFetcher{
+		Guard:  guard,
+		Client: client,
+		Header: http.Header{},
+	}
+}
+
+func (f *HTTPFetcher) Fetch(ctx context.Context, u *url.URL) (*Object, error) {
+	if err := f.Guard.checkURL(u.Scheme, u.Hostname()); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range f.Header {
+		req.Header[key] = values
+	}
+	if f.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+f.BearerToken)
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &StatusError{URL: u.Redacted(), StatusCode: resp.StatusCode}
+	}
+
+	return &Object{
+		Name: path.Base(resp.Request.URL.Path),
+		Body: resp.Body,
+		Size: resp.ContentLength,
+	}, nil
+}
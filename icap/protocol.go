@@ -0,0 +1,344 @@
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrMalformedRequest = errors.New("malformed icap request")
+
+// MaxHeaderSize is the maximum combined size of the encapsulated req-hdr and res-hdr sections
+const MaxHeaderSize = 64 << 10
+
+// Request is an ICAP request (RFC 3507). The encapsulated HTTP headers are kept as raw bytes.
+type Request struct {
+	Method string
+	URL    *url.URL
+	Proto  string
+	Header textproto.MIMEHeader
+	// ReqHeader and ResHeader are the encapsulated HTTP headers including the empty line
+	ReqHeader []byte
+	ResHeader []byte
+	// Body is the decoded encapsulated body. It is nil if the request has no body.
+	Body *Body
+}
+
+// Preview returns the size of the preview or -1 if the request has none
+func (r *Request) Preview() int {
+	v := r.Header.Get("Preview")
+	if v == "" {
+		return -1
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// Allows returns whether the client allows the status code, e.g. 204
+func (r *Request) Allows(code int) bool {
+	for _, v := range r.Header.Values("Allow") {
+		for _, c := range strings.Split(v, ",") {
+			if strings.TrimSpace(c) == strconv.Itoa(code) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HTTPURL returns the url of the encapsulated HTTP request
+func (r *Request) HTTPURL() string {
+	line, _, _ := bytes.Cut(r.ReqHeader, []byte("\r\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+// ReadRequest reads an ICAP request from r. If the request contains a preview,
+// '100 Continue' is written to w once the body is read beyond the preview.
+func ReadRequest(r *bufio.Reader, w *bufio.Writer) (*Request, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	method, rest, ok1 := strings.Cut(line, " ")
+	rawURL, proto, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || !strings.HasPrefix(proto, "ICAP/") {
+		return nil, fmt.Errorf("%w: invalid request line %q", ErrMalformedRequest, line)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
+	}
+	req := &Request{Method: method, URL: u, Proto: proto, Header: header}
+
+	sections, err := parseEncapsulated(header.Get("Encapsulated"))
+	if err != nil {
+		return nil, err
+	}
+	if size := headerSize(sections); size > MaxHeaderSize {
+		return nil, fmt.Errorf("%w: encapsulated headers of %d bytes exceed the limit of %d bytes", ErrMalformedRequest, size, MaxHeaderSize)
+	}
+	headers := io.LimitReader(r, MaxHeaderSize)
+	for i, s := range sections {
+		if strings.HasSuffix(s.name, "-body") {
+			if s.name != "null-body" {
+				req.Body = newBody(r, w, req.Preview() >= 0)
+			}
+			break
+		}
+		if i+1 >= len(sections) {
+			return nil, fmt.Errorf("%w: encapsulated header section %q has no end", ErrMalformedRequest, s.name)
+		}
+		buf := make([]byte, sections[i+1].offset-s.offset)
+		if _, err := io.ReadFull(headers, buf); err != nil {
+			return nil, err
+		}
+		switch s.name {
+		case "req-hdr":
+			req.ReqHeader = buf
+		case "res-hdr":
+			req.ResHeader = buf
+		}
+	}
+	return req, nil
+}
+
+type section struct {
+	name   string
+	offset int
+}
+
+// headerSize returns the combined size of the header sections, which precede the body section
+func headerSize(sections []section) int {
+	if len(sections) == 0 {
+		return 0
+	}
+	end := sections[len(sections)-1].offset
+	for _, s := range sections {
+		if strings.HasSuffix(s.name, "-body") {
+			end = s.offset
+			break
+		}
+	}
+	return end - sections[0].offset
+}
+
+// parseEncapsulated parses the Encapsulated header, e.g. 'req-hdr=0, res-hdr=137, res-body=296'
+func parseEncapsulated(v string) ([]section, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var sections []section
+	for _, entry := range strings.Split(v, ",") {
+		name, rawOffset, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		offset, err := strconv.Atoi(rawOffset)
+		if !ok || err != nil || offset < 0 {
+			return nil, fmt.Errorf("%w: invalid Encapsulated header %q", ErrMalformedRequest, v)
+		}
+		sections = append(sections, section{name: name, offset: offset})
+	}
+	if !sort.SliceIsSorted(sections, func(i, j int) bool { return sections[i].offset < sections[j].offset }) {
+		return nil, fmt.Errorf("%w: invalid Encapsulated header %q", ErrMalformedRequest, v)
+	}
+	return sections, nil
+}
+
+// Body reads a chunked encapsulated body. Once the preview is read and the client did
+// not indicate the end of the body with 'ieof', '100 Continue' is sent to receive the rest.
+type Body struct {
+	r       *bufio.Reader
+	w       *bufio.Writer
+	preview bool
+	// n is the remaining size of the current chunk
+	n    int64
+	eof  bool
+	ieof bool
+}
+
+func newBody(r *bufio.Reader, w *bufio.Writer, preview bool) *Body {
+	return &Body{r: r, w: w, preview: preview}
+}
+
+func (b *Body) Read(p []byte) (int, error) {
+	for {
+		if b.eof {
+			if !b.preview || b.ieof {
+				return 0, io.EOF
+			}
+			// the body is longer than the preview
+			b.preview, b.eof = false, false
+			if _, err := b.w.WriteString("ICAP/1.0 100 Continue\r\n\r\n"); err != nil {
+				return 0, err
+			}
+			if err := b.w.Flush(); err != nil {
+				return 0, err
+			}
+		}
+		if b.n == 0 {
+			if err := b.readChunkHeader(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if int64(len(p)) > b.n {
+			p = p[:b.n]
+		}
+		n, err := b.r.Read(p)
+		b.n -= int64(n)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil && b.n == 0 {
+			err = b.readCRLF()
+		}
+		return n, err
+	}
+}
+
+// Complete returns whether the body was read entirely
+func (b *Body) Complete() bool {
+	return b.eof && (!b.preview || b.ieof)
+}
+
+func (b *Body) readChunkHeader() error {
+	line, err := b.r.ReadString('\n')
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	rawSize, ext, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(rawSize), 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("%w: invalid chunk size %q", ErrMalformedRequest, rawSize)
+	}
+	if size > 0 {
+		b.n = size
+		return nil
+	}
+	b.eof = true
+	b.ieof = strings.TrimSpace(ext) == "ieof"
+	// trailer is not supported, the zero chunk must be followed by an empty line
+	return b.readCRLF()
+}
+
+func (b *Body) readCRLF() error {
+	line, err := b.r.ReadString('\n')
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if strings.TrimRight(line, "\r\n") != "" {
+		return fmt.Errorf("%w: missing CRLF after chunk", ErrMalformedRequest)
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Response is an ICAP response. The encapsulated HTTP headers and body are written as they are.
+type Response struct {
+	StatusCode int
+	Header     textproto.MIMEHeader
+	ReqHeader  []byte
+	ResHeader  []byte
+	// Body is written chunked. If it is nil, the response has no body.
+	Body []byte
+}
+
+func NewResponse(code int) *Response {
+	return &Response{StatusCode: code, Header: textproto.MIMEHeader{}}
+}
+
+// Write writes the response to w and sets the Encapsulated header
+func (r *Response) Write(w *bufio.Writer) error {
+	var encapsulated []string
+	offset := 0
+	if r.ReqHeader != nil {
+		encapsulated = append(encapsulated, fmt.Sprintf("req-hdr=%d", offset))
+		offset += len(r.ReqHeader)
+	}
+	if r.ResHeader != nil {
+		encapsulated = append(encapsulated, fmt.Sprintf("res-hdr=%d", offset))
+		offset += len(r.ResHeader)
+	}
+	switch {
+	case r.Body == nil:
+		encapsulated = append(encapsulated, fmt.Sprintf("null-body=%d", offset))
+	case r.ResHeader != nil:
+		encapsulated = append(encapsulated, fmt.Sprintf("res-body=%d", offset))
+	default:
+		encapsulated = append(encapsulated, fmt.Sprintf("req-body=%d", offset))
+	}
+	r.Header.Set("Encapsulated", strings.Join(encapsulated, ", "))
+
+	fmt.Fprintf(w, "ICAP/1.0 %d %s\r\n", r.StatusCode, StatusText(r.StatusCode))
+	keys := make([]string, 0, len(r.Header))
+	for key := range r.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, v := range r.Header[key] {
+			fmt.Fprintf(w, "%s: %s\r\n", key, v)
+		}
+	}
+	w.WriteString("\r\n")
+
+	w.Write(r.ReqHeader)
+	w.Write(r.ResHeader)
+	if r.Body != nil {
+		if len(r.Body) > 0 {
+			fmt.Fprintf(w, "%x\r\n", len(r.Body))
+			w.Write(r.Body)
+			w.WriteString("\r\n")
+		}
+		w.WriteString("0\r\n\r\n")
+	}
+	return w.Flush()
+}
+
+func StatusText(code int) string {
+	switch code {
+	case 100:
+		return "Continue"
+	case 200:
+		return "OK"
+	case 204:
+		return "No Content"
+	case 400:
+		return "Bad Request"
+	case 404:
+		return "ICAP Service Not Found"
+	case 405:
+		return "Method Not Allowed For Service"
+	case 500:
+		return "Server Error"
+	case 501:
+		return "Method Not Implemented"
+	case 505:
+		return "ICAP Version Not Supported"
+	}
+	return "Unknown"
+}
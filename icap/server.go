@@ -0,0 +1,341 @@
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/go-common-utils/log"
+)
+
+const (
+	ServiceREQMOD  = "/reqmod"
+	ServiceRESPMOD = "/respmod"
+)
+
+// Client is the part of the clamav client which is used by the server
+type Client interface {
+	Scan(context.Context, io.Reader) (*clamav.ScanResult, error)
+	Version(ctx context.Context) (*clamav.VersionInfo, error)
+	MaxFilesize() int
+}
+
+// Server is an ICAP server (RFC 3507) which scans the bodies of REQMOD and RESPMOD requests.
+// REQMOD is served at '/reqmod' and RESPMOD at '/respmod'.
+type Server struct {
+	Addr     string
+	Log      log.Logger
+	StopChan <-chan struct{}
+	client   Client
+	tlsCfg   *tls.Config
+	listener net.Listener
+	// Timeout is the maximum duration of a request including the scan
+	Timeout time.Duration
+	// IdleTimeout is the maximum duration a connection waits for the next request
+	IdleTimeout time.Duration
+	// PreviewSize is the size of the preview which is requested from the clients
+	PreviewSize int
+	// FailOpen allows content if it could not be scanned. Otherwise an error is returned.
+	FailOpen bool
+	// BlockPage is the html which replaces infected content
+	BlockPage *template.Template
+	// ISTagTTL is the interval in which the ISTag, which is derived from the signature database, is refreshed
+	ISTagTTL time.Duration
+
+	istagMu sync.Mutex
+	istag   string
+}
+
+// BlockPageData is passed to the block page template
+type BlockPageData struct {
+	URL       string
+	Signature string
+}
+
+var DefaultBlockPage = template.Must(template.New("blockpage").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Access denied</title></head>
+<body>
+<h1>Access denied</h1>
+<p>The requested content contains a virus and has been blocked.</p>
+<p>URL: {{ .URL }}<br>Virus: {{ .Signature }}</p>
+</body>
+</html>
+`))
+
+func NewServer(addr string, client Client, stopChan <-chan struct{}, logger log.Logger, tlsCfg *tls.Config) *Server {
+	return &Server{
+		Addr:        addr,
+		Log:         logger,
+		StopChan:    stopChan,
+		client:      client,
+		tlsCfg:      tlsCfg,
+		Timeout:     time.Minute,
+		IdleTimeout: 60 * time.Second,
+		PreviewSize: 1024,
+		BlockPage:   DefaultBlockPage,
+		ISTagTTL:    time.Minute,
+	}
+}
+
+func (s *Server) ToString() string {
+	return fmt.Sprintf(
+		"addr='%s', timeout='%s', idle_timeout='%s', preview='%d', fail_open='%t'",
+		s.Addr, s.Timeout, s.IdleTimeout, s.PreviewSize, s.FailOpen,
+	)
+}
+
+// Listen opens the listener of the server. It is called by Run if the listener is not open yet.
+func (s *Server) Listen() (err error) {
+	s.listener, err = net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if s.tlsCfg != nil {
+		s.listener = tls.NewListener(s.listener, s.tlsCfg)
+	}
+	return nil
+}
+
+// Run serves connections until the StopChan is closed
+func (s *Server) Run() {
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
+			s.Log.Error("failed to open tcp port", "error", err, "addr", s.Addr)
+			return
+		}
+	}
+
+	schema := "icap"
+	if s.tlsCfg != nil {
+		schema = "icaps"
+	}
+
+	go func() {
+		s.Log.Debug(s.ToString())
+		s.Log.Info("Starting ICAP server", "addr", fmt.Sprintf("%s://%s", schema, s.Addr))
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				s.Log.Warn("Failed to accept connection", "error", err)
+				continue
+			}
+			go s.serveConn(conn)
+		}
+	}()
+
+	go s.refreshISTag()
+
+	//  handle shutdown
+	<-s.StopChan
+
+	s.Log.Warn("Shutting down ICAP server")
+	if err := s.listener.Close(); err != nil {
+		s.Log.Error("icap server shutdown failed", "error", err)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		if s.IdleTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		if _, err := r.Peek(1); err != nil {
+			return
+		}
+		if s.Timeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.Timeout))
+		}
+
+		req, err := ReadRequest(r, w)
+		if err != nil {
+			s.Log.Warn("Failed to read request", "error", err, "remote", conn.RemoteAddr().String())
+			resp := s.newResponse(400)
+			resp.Header.Set("Connection", "close")
+			resp.Write(w)
+			return
+		}
+
+		resp := s.handle(req)
+		// the connection can not be reused if the body was not read entirely
+		keepAlive := req.Body == nil || req.Body.Complete()
+		if !keepAlive {
+			resp.Header.Set("Connection", "close")
+		}
+		if err := resp.Write(w); err != nil {
+			s.Log.Warn("Failed to write response", "error", err, "remote", conn.RemoteAddr().String())
+			return
+		}
+		if !keepAlive || strings.EqualFold(req.Header.Get("Connection"), "close") {
+			return
+		}
+	}
+}
+
+func (s *Server) handle(req *Request) *Response {
+	methods := map[string]string{ServiceREQMOD: "REQMOD", ServiceRESPMOD: "RESPMOD"}
+	method, ok := methods[req.URL.Path]
+	if !ok {
+		return s.newResponse(404)
+	}
+
+	switch req.Method {
+	case "OPTIONS":
+		resp := s.newResponse(200)
+		resp.Header.Set("Methods", method)
+		resp.Header.Set("Service", "clamav-facade")
+		resp.Header.Set("Allow", "204")
+		resp.Header.Set("Preview", fmt.Sprint(s.PreviewSize))
+		resp.Header.Set("Transfer-Preview", "*")
+		if s.ISTagTTL > 0 {
+			resp.Header.Set("Options-TTL", fmt.Sprint(int(s.ISTagTTL.Seconds())))
+		}
+		return resp
+
+	case "REQMOD", "RESPMOD":
+		if req.Method != method {
+			return s.newResponse(405)
+		}
+		return s.scan(req)
+	}
+	return s.newResponse(501)
+}
+
+func (s *Server) scan(req *Request) *Response {
+	if req.Body == nil {
+		return s.allow(req, nil)
+	}
+
+	// without 204 the content must be returned
+	var body bytes.Buffer
+	var reader io.Reader = req.Body
+	if !req.Allows(204) {
+		reader = io.TeeReader(req.Body, &body)
+	}
+
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	url := req.HTTPURL()
+	res, err := s.client.Scan(ctx, clamav.LimitReader(reader, s.client.MaxFilesize()))
+	if err != nil {
+		s.Log.Warn("Failed to scan content", "url", url, "error", err)
+		if s.FailOpen && (req.Allows(204) || req.Body.Complete()) {
+			return s.allow(req, body.Bytes())
+		}
+		return s.newResponse(500)
+	}
+
+	if res.Infected() {
+		s.Log.Warn("Blocked content", "url", url, "signature", res.Signature())
+		return s.block(url, res.Signature())
+	}
+
+	s.Log.Info("Allowed content", "url", url, "size", res.Size)
+	return s.allow(req, body.Bytes())
+}
+
+// allow returns the unmodified content
+func (s *Server) allow(req *Request, body []byte) *Response {
+	if req.Allows(204) {
+		return s.newResponse(204)
+	}
+
+	resp := s.newResponse(200)
+	if req.Method == "RESPMOD" {
+		resp.ResHeader = req.ResHeader
+	} else {
+		resp.ReqHeader = req.ReqHeader
+	}
+	if req.Body != nil {
+		resp.Body = body
+	}
+	return resp
+}
+
+// block replaces the content with the block page
+func (s *Server) block(url, signature string) *Response {
+	var page bytes.Buffer
+	if err := s.BlockPage.Execute(&page, BlockPageData{URL: url, Signature: signature}); err != nil {
+		s.Log.Error("Failed to render block page", "error", err)
+	}
+	infection := fmt.Sprintf("Type=0; Resolution=2; Threat=%s;", signature)
+
+	resp := s.newResponse(200)
+	resp.Header.Set("X-Infection-Found", infection)
+	resp.ResHeader = []byte(fmt.Sprintf("HTTP/1.1 403 Forbidden\r\n"+
+		"Content-Type: text/html; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"Cache-Control: no-store\r\n"+
+		"X-Infection-Found: %s\r\n"+
+		"Connection: close\r\n\r\n", page.Len(), infection))
+	resp.Body = page.Bytes()
+	return resp
+}
+
+func (s *Server) newResponse(code int) *Response {
+	resp := NewResponse(code)
+	resp.Header.Set("ISTag", s.currentISTag())
+	return resp
+}
+
+// currentISTag returns the tag of the service. It changes once the signature database is updated.
+func (s *Server) currentISTag() string {
+	s.istagMu.Lock()
+	defer s.istagMu.Unlock()
+	if s.istag == "" {
+		return `"CF-0"`
+	}
+	return s.istag
+}
+
+// refreshISTag derives the ISTag from the version of the signature database every ISTagTTL until the StopChan is closed.
+// If the version can not be retrieved, the previous tag is kept.
+func (s *Server) refreshISTag() {
+	interval := s.ISTagTTL
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		info, err := s.client.Version(ctx)
+		cancel()
+		if err != nil {
+			s.Log.Warn("Failed to get version of clamav", "error", err)
+		} else {
+			s.istagMu.Lock()
+			s.istag = fmt.Sprintf(`"CF-%d"`, info.Database)
+			s.istagMu.Unlock()
+		}
+
+		select {
+		case <-s.StopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
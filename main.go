@@ -4,8 +4,12 @@ import (
 	"crypto/tls"
 	"crypto/x509/pkix"
 	"flag"
+	"fmt"
+	"html/template"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -13,8 +17,14 @@ import (
 	log "github.com/ron96G/go-common-utils/log"
 
 	"github.com/ron96G/clamav-facade/api"
+	"github.com/ron96G/clamav-facade/archive"
 	"github.com/ron96G/clamav-facade/clamav"
 	"github.com/ron96G/clamav-facade/cmd"
+	"github.com/ron96G/clamav-facade/fetch"
+	"github.com/ron96G/clamav-facade/icap"
+	"github.com/ron96G/clamav-facade/milter"
+	"github.com/ron96G/clamav-facade/proxy"
+	"github.com/ron96G/clamav-facade/webhook"
 
 	"net/http"
 	_ "net/http/pprof"
@@ -23,23 +33,88 @@ import (
 var (
 	enablePprof = flag.Bool("pprof", false, "enable pprof")
 
-	loglevel  = flag.String("loglevel", "info", "loglevel of the application")
-	logformat = flag.String("logformat", "json", "logformat of the application")
-	hostname  = flag.String("client.hostname", "localhost", "the hostname of clamd")
-	port      = flag.Uint("client.port", 3310, "the port of clamd")
-	timeout   = flag.Duration("client.timeout", time.Second*10, "clamd connection timeout")
-	maxSize   = flag.Int("maxsize", 25, "file size limit in mb")
-
-	startAPI     = flag.Bool("api", false, "start the API")
-	timeoutRead  = flag.Duration("api.readtimeout", time.Second*15, "http server timeout for reading request (requires --api)")
-	timeoutWrite = flag.Duration("api.writetimeout", time.Second*15, "http server timeout for writing response (requires --api)")
-	address      = flag.String("api.addr", "0.0.0.0:8080", "the address of the API (requires --api)")
-	prefix       = flag.String("api.prefix", "", "the prefix of the API (requires --api)")
-	enableTLS    = flag.Bool("api.tls", false, "enable TLS on the API (requires --api)")
-	pemFile      = flag.String("pem", "", "PEM file for server TLS. If empty, a self-signed is generated")
-	p12File      = flag.String("p12", "", "P12 file for server TLS. Use 'P12_PASSWORD' to provide the password. If empty, a self-signed is generated")
+	loglevel   = flag.String("loglevel", "info", "loglevel of the application")
+	logformat  = flag.String("logformat", "json", "logformat of the application")
+	hostname   = flag.String("client.hostname", "localhost", "the hostname of clamd")
+	port       = flag.Uint("client.port", 3310, "the port of clamd")
+	clientAddr = flag.String("client.address", "", "the address of clamd, e.g. 'unix:///run/clamav/clamd.ctl' or 'tcp://localhost:3310'. Multiple addresses are separated by comma. Overrides --client.hostname and --client.port")
+	timeout    = flag.Duration("client.timeout", time.Second*10, "clamd connection timeout")
+	maxSize    = flag.Int("maxsize", 25, "file size limit in mb")
+
+	enablePool      = flag.Bool("client.pool", false, "reuse connections to clamd using IDSESSION")
+	poolMaxIdle     = flag.Int("client.pool.maxidle", clamav.DefaultPoolOptions.MaxIdle, "maximum number of idle sessions (requires --client.pool)")
+	poolMaxIdleTime = flag.Duration("client.pool.maxidletime", clamav.DefaultPoolOptions.MaxIdleTime, "idle sessions are closed after this duration. Must be lower than 'IdleTimeout' of clamd (requires --client.pool)")
+	poolMaxLifetime = flag.Duration("client.pool.maxlifetime", clamav.DefaultPoolOptions.MaxLifetime, "sessions are not reused after this duration (requires --client.pool)")
+
+	retries          = flag.Int("client.retries", clamav.DefaultRetryPolicy.MaxAttempts-1, "number of retries of failed idempotent requests to clamd")
+	retryBackoff     = flag.Duration("client.retry.backoff", clamav.DefaultRetryPolicy.InitialBackoff, "initial backoff between retries. It is doubled for every retry")
+	retryMaxBackoff  = flag.Duration("client.retry.maxbackoff", clamav.DefaultRetryPolicy.MaxBackoff, "maximum backoff between retries")
+	breakerThreshold = flag.Int("client.breaker.threshold", clamav.DefaultBreakerOptions.Threshold, "consecutive failures after which requests to clamd fail fast. 0 disables the circuit breaker")
+	breakerCooldown  = flag.Duration("client.breaker.cooldown", clamav.DefaultBreakerOptions.Cooldown, "duration after which clamd is tried again once the circuit breaker opened")
+
+	archiveDepth   = flag.Int("archive.maxdepth", archive.DefaultLimits.MaxDepth, "maximum nesting of archives which are expanded with 'expand=true' or --expand. 0 disables the limit")
+	archiveEntries = flag.Int("archive.maxentries", archive.DefaultLimits.MaxEntries, "maximum number of entries of an expanded archive including nested archives. 0 disables the limit")
+	archiveRatio   = flag.Float64("archive.maxratio", archive.DefaultLimits.MaxRatio, "maximum compression ratio of an entry of an expanded archive. 0 disables the limit")
+	archiveSize    = flag.Int64("archive.maxsize", archive.DefaultLimits.MaxSize>>20, "maximum uncompressed size of all entries of an expanded archive in mb. 0 disables the limit")
+
+	strategy       = flag.String("client.strategy", string(clamav.DefaultGroupOptions.Strategy), "load balancing strategy for multiple clamd addresses. One of 'round-robin', 'least-outstanding' or 'least-queue'")
+	healthInterval = flag.Duration("client.healthinterval", clamav.DefaultGroupOptions.HealthInterval, "interval of health checks for multiple clamd addresses")
+
+	startAPI       = flag.Bool("api", false, "start the API")
+	timeoutRead    = flag.Duration("api.readtimeout", time.Second*15, "http server timeout for reading request (requires --api)")
+	timeoutWrite   = flag.Duration("api.writetimeout", time.Second*15, "http server timeout for writing response (requires --api)")
+	address        = flag.String("api.addr", "0.0.0.0:8080", "the address of the API (requires --api)")
+	prefix         = flag.String("api.prefix", "", "the prefix of the API (requires --api)")
+	statsInterval  = flag.Duration("api.statsinterval", time.Second*15, "interval in which the stats of clamd are exported as metrics. 0 disables the export (requires --api)")
+	maxDBAge       = flag.Duration("api.ready.maxdbage", time.Hour*72, "maximum age of the signature database until the API is no longer ready. 0 disables the check (requires --api)")
+	maxQueue       = flag.Int("api.ready.maxqueue", 0, "maximum length of the queue of clamd until the API is no longer ready. 0 disables the check (requires --api)")
+	batchPolicy    = flag.String("api.batchpolicy", string(api.Continue), "whether the remaining files of a request are scanned once a file failed. One of 'continue' or 'fail-fast' (requires --api)")
+	urlAllowHosts  = flag.String("api.url.allowhosts", "", "comma-separated hosts which can be scanned by url. '*.example.com' matches all subdomains. Empty allows all hosts (requires --api)")
+	urlDenyHosts   = flag.String("api.url.denyhosts", "", "comma-separated hosts which can not be scanned by url (requires --api)")
+	urlAllowCIDRs  = flag.String("api.url.allowcidrs", "", "comma-separated networks which can be scanned by url. Internal addresses are blocked unless allowed here (requires --api)")
+	urlDenyCIDRs   = flag.String("api.url.denycidrs", "", "comma-separated networks which can not be scanned by url (requires --api)")
+	urlRedirects   = flag.Int("api.url.maxredirects", 5, "maximum number of redirects when scanning by url (requires --api)")
+	urlTimeout     = flag.Duration("api.url.timeout", time.Second*30, "timeout for downloading a file when scanning by url (requires --api)")
+	jobWorkers     = flag.Int("api.jobs.workers", 4, "number of jobs which are scanned concurrently (requires --api)")
+	jobQueue       = flag.Int("api.jobs.queue", 100, "number of jobs which can wait for a worker (requires --api)")
+	jobTTL         = flag.Duration("api.jobs.ttl", time.Hour, "duration for which finished jobs are kept (requires --api)")
+	jobTimeout     = flag.Duration("api.jobs.timeout", time.Minute*30, "maximum duration of a job (requires --api)")
+	webhookURL     = flag.String("api.webhook.infected", "", "webhook which receives every response containing a virus. Use 'WEBHOOK_SECRET' to sign the deliveries (requires --api)")
+	webhookTries   = flag.Int("api.webhook.attempts", 5, "maximum number of attempts to deliver a webhook (requires --api)")
+	webhookWait    = flag.Duration("api.webhook.backoff", time.Second, "initial backoff between attempts to deliver a webhook. It is doubled for every retry (requires --api)")
+	webhookTime    = flag.Duration("api.webhook.timeout", time.Second*10, "timeout of a single attempt to deliver a webhook (requires --api)")
+	fetchTimeout   = flag.Duration("fetch.timeout", time.Minute*5, "timeout for downloading a file with --file")
+	s3Endpoint     = flag.String("fetch.s3.endpoint", "", "endpoint of the S3-compatible service for s3:// urls. Empty uses AWS. Use 'AWS_ACCESS_KEY_ID', 'AWS_SECRET_ACCESS_KEY' and 'AWS_SESSION_TOKEN' to provide the credentials")
+	s3Region       = flag.String("fetch.s3.region", "us-east-1", "region of the S3-compatible service for s3:// urls")
+	s3Buckets      = flag.String("fetch.s3.buckets", "", "comma-separated buckets which can be fetched by s3:// urls with the credentials of the facade. Empty disables s3:// urls")
+	httpHeaders    headerFlag
+	enableTLS      = flag.Bool("api.tls", false, "enable TLS on the API (requires --api)")
+	startICAP      = flag.Bool("icap", false, "start the ICAP server. REQMOD is served at '/reqmod' and RESPMOD at '/respmod'")
+	icapAddr       = flag.String("icap.addr", "0.0.0.0:1344", "the address of the ICAP server (requires --icap)")
+	icapTLS        = flag.Bool("icap.tls", false, "enable TLS on the ICAP server. The certificate is configured like the one of the API (requires --icap)")
+	icapTimeout    = flag.Duration("icap.timeout", time.Minute, "maximum duration of an ICAP request including the scan (requires --icap)")
+	icapPreview    = flag.Int("icap.preview", 1024, "size of the preview which is requested from ICAP clients (requires --icap)")
+	icapFailOpen   = flag.Bool("icap.failopen", false, "allow content which could not be scanned. Otherwise an error is returned to the ICAP client (requires --icap)")
+	icapBlockPage  = flag.String("icap.blockpage", "", "html template which replaces infected content. '{{ .URL }}' and '{{ .Signature }}' are replaced. If empty, a default page is used (requires --icap)")
+	startProxy     = flag.Bool("proxy", false, "start a listener which speaks the clamd protocol and forwards PING, VERSION and INSTREAM to the client")
+	proxyAddr      = flag.String("proxy.addr", "0.0.0.0:3310", "the address of the clamd proxy. Use 'unix:///path/to/socket' for a unix socket (requires --proxy)")
+	proxyCIDRs     = flag.String("proxy.allowcidrs", "", "comma-separated networks which can connect to the clamd proxy. Empty allows all (requires --proxy)")
+	proxyTimeout   = flag.Duration("proxy.timeout", time.Minute, "maximum duration of a command of the clamd proxy including the scan (requires --proxy)")
+	startMilter    = flag.Bool("milter", false, "start a milter which scans every part of the messages of sendmail or postfix")
+	milterAddr     = flag.String("milter.addr", "0.0.0.0:7357", "the address of the milter. Use 'unix:///path/to/socket' for a unix socket (requires --milter)")
+	milterInfected = flag.String("milter.infected", string(milter.ActionReject), "action for messages which contain a virus. One of 'accept', 'reject', 'tempfail', 'discard', 'quarantine' or 'add-header' (requires --milter)")
+	milterFailed   = flag.String("milter.failed", string(milter.ActionTempFail), "action for messages which could not be scanned. One of 'accept', 'reject', 'tempfail', 'discard', 'quarantine' or 'add-header' (requires --milter)")
+	milterHeader   = flag.String("milter.header", milter.DefaultPolicy.Header, "header which is added by the 'add-header' action (requires --milter)")
+	milterMaxSize  = flag.Int("milter.maxsize", 50<<20, "maximum size of a message in bytes. Larger messages are handled like failed scans (requires --milter)")
+	milterTimeout  = flag.Duration("milter.timeout", time.Minute*5, "maximum duration of the scan of a message (requires --milter)")
+	pemFile        = flag.String("pem", "", "PEM file for server TLS. If empty, a self-signed is generated")
+	p12File        = flag.String("p12", "", "P12 file for server TLS. Use 'P12_PASSWORD' to provide the password. If empty, a self-signed is generated")
 )
 
+func init() {
+	flag.Var(&httpHeaders, "fetch.http.header", "header of the form 'Name: value' which is sent when downloading a file with --file. Can be repeated. Use 'FETCH_BEARER_TOKEN' to provide a bearer token")
+}
+
 func main() {
 	flag.Parse()
 	log.Reset()
@@ -51,52 +126,187 @@ func main() {
 		}()
 	}
 
-	client, err := clamav.NewClamavClient(*hostname, *port, *timeout)
-	if err != nil {
-		log.Error("failed to create new clamav client", "error", err.Error())
+	var clients []*clamav.ClamavClient
+	if *clientAddr != "" {
+		for _, addr := range strings.Split(*clientAddr, ",") {
+			c, err := clamav.NewClamavClientFromAddress(strings.TrimSpace(addr), *timeout)
+			if err != nil {
+				log.Error("failed to create new clamav client", "error", err.Error(), "address", addr)
+				os.Exit(1)
+			}
+			clients = append(clients, c)
+		}
+	} else {
+		c, err := clamav.NewClamavClient(*hostname, *port, *timeout)
+		if err != nil {
+			log.Error("failed to create new clamav client", "error", err.Error())
+			os.Exit(1)
+		}
+		clients = append(clients, c)
+	}
+
+	fetchers := newFetchers()
+	for _, c := range clients {
+		c.Fetchers = fetchers
+		c.SetMaxSize(*maxSize * 1024 * 1024)
+		c.Log = log.New("client_logger", "address", c.Address)
+		// the api attaches the signature database to every result
+		c.ScanVersion = *startAPI
+		c.SetRetryPolicy(clamav.RetryPolicy{
+			MaxAttempts:    *retries + 1,
+			InitialBackoff: *retryBackoff,
+			MaxBackoff:     *retryMaxBackoff,
+			Multiplier:     clamav.DefaultRetryPolicy.Multiplier,
+			Jitter:         clamav.DefaultRetryPolicy.Jitter,
+		})
+		c.EnableCircuitBreaker(clamav.BreakerOptions{
+			Threshold: *breakerThreshold,
+			Cooldown:  *breakerCooldown,
+		})
+		if *enablePool {
+			c.EnablePool(clamav.PoolOptions{
+				MaxIdle:     *poolMaxIdle,
+				MaxIdleTime: *poolMaxIdleTime,
+				MaxLifetime: *poolMaxLifetime,
+			})
+		}
+	}
+
+	var client api.Client = clients[0]
+	if len(clients) > 1 {
+		s, err := clamav.ParseStrategy(*strategy)
+		if err != nil {
+			log.Error("failed to create backend group", "error", err.Error())
+			os.Exit(1)
+		}
+		group, err := clamav.NewBackendGroup(clients, clamav.GroupOptions{
+			Strategy:       s,
+			HealthInterval: *healthInterval,
+		}, log.New("group_logger"))
+		if err != nil {
+			log.Error("failed to create backend group", "error", err.Error())
+			os.Exit(1)
+		}
+		defer group.Close()
+		client = group
+	} else {
+		defer clients[0].Close()
+	}
+
+	if !*startAPI && !*startICAP && !*startProxy && !*startMilter {
+		// commands
+		cmd.Run(client, cmd.Config{Fetchers: fetchers, Limits: newArchiveLimits()}, log.New("cmd_logger"))
+		return
+	}
+
+	// the servers share the tls config and are stopped by the same signal
+	var tlsCfg *tls.Config
+	if *enableTLS || *icapTLS {
+		var err error
+		tlsCfg, err = cert.GetServerTLS(cert.Options{
+			PemFile:  *pemFile,
+			P12File:  *p12File,
+			Password: os.Getenv("P12_PASSWORD"),
+			Subject: pkix.Name{
+				Organization: []string{"DMC Virusscanner Facade"},
+				Country:      []string{"DE"},
+				Province:     []string{"NRW"},
+				Locality:     []string{"Bonn"},
+			},
+		})
+		if err != nil {
+			log.Error("failed to setup tls config", "error", err)
+		}
+	}
+	stopChan := SetupSignalHandler()
+	var wg sync.WaitGroup
+
+	// ICAP config
+	if *startICAP {
+		server, err := newICAPServer(client, stopChan, tlsCfg)
+		if err != nil {
+			log.Error("failed to configure ICAP server", "error", err.Error())
+			os.Exit(1)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Run()
+		}()
+	}
+
+	// clamd proxy config
+	if *startProxy {
+		server, err := newProxyServer(client, stopChan)
+		if err != nil {
+			log.Error("failed to configure clamd proxy", "error", err.Error())
+			os.Exit(1)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Run()
+		}()
+	}
+
+	// milter config
+	if *startMilter {
+		server, err := newMilterServer(client, stopChan)
+		if err != nil {
+			log.Error("failed to configure milter", "error", err.Error())
+			os.Exit(1)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Run()
+		}()
 	}
-	client.SetMaxSize(*maxSize * 1024 * 1024)
-	client.Log = log.New("client_logger")
 
 	// API config
 	if *startAPI {
-		var tlsCfg *tls.Config
-		if *enableTLS {
-			tlsCfg, err = cert.GetServerTLS(cert.Options{
-				PemFile:  *pemFile,
-				P12File:  *p12File,
-				Password: os.Getenv("P12_PASSWORD"),
-				Subject: pkix.Name{
-					Organization: []string{"DMC Virusscanner Facade"},
-					Country:      []string{"DE"},
-					Province:     []string{"NRW"},
-					Locality:     []string{"Bonn"},
-				},
-			})
-			if err != nil {
-				log.Error("failed to setup tls config", "error", err)
-			}
+		apiTLSCfg := tlsCfg
+		if !*enableTLS {
+			apiTLSCfg = nil
 		}
 
-		// If the API write timeout is lower than the client timeout, the api request will timeout without
-		// an error. Therefore, the client timeout must be lower to prevent this.
-		if *timeoutWrite <= *timeout {
-			// The new client timeout is 90% of the write timeout
-			newTimeout := time.Duration(float64(*timeoutWrite) * 0.9)
-			log.Warn("Client timeout exceeds write timeout...", "client_timeout", newTimeout)
-			client.SetDefaultTimeout(newTimeout)
+		policy, err := api.ParseBatchPolicy(*batchPolicy)
+		if err != nil {
+			log.Error("failed to configure API", "error", err.Error())
+			os.Exit(1)
 		}
 
-		stopChan := SetupSignalHandler()
-		api := api.NewAPI(*prefix, *address, client, stopChan, log.New("api_logger"), tlsCfg)
+		guard, err := newGuard()
+		if err != nil {
+			log.Error("failed to configure API", "error", err.Error())
+			os.Exit(1)
+		}
+
+		api := api.NewAPI(*prefix, *address, client, stopChan, log.New("api_logger"), apiTLSCfg)
 		api.ReadTimeout = *timeoutRead
 		api.WriteTimeout = *timeoutWrite
+		api.StatsInterval = *statsInterval
+		api.MaxDatabaseAge = *maxDBAge
+		api.MaxQueueLength = *maxQueue
+		api.BatchPolicy = policy
+		api.ArchiveLimits = newArchiveLimits()
+		api.JobWorkers = *jobWorkers
+		api.JobQueueSize = *jobQueue
+		api.JobTTL = *jobTTL
+		api.JobTimeout = *jobTimeout
+		api.Fetchers = fetch.NewRemoteRegistry(guard, *urlTimeout)
+		if s3 := newS3Fetcher(*urlTimeout); s3 != nil {
+			api.Fetchers.Register("s3", s3)
+		}
+		// callbacks are restricted like urls since callback urls are provided by the clients
+		secret := []byte(os.Getenv("WEBHOOK_SECRET"))
+		api.Webhooks = newWebhookSender(guard.Client(*webhookTime), secret)
+		api.InfectionWebhook = *webhookURL
+		api.InfectionSender = newWebhookSender(&http.Client{Timeout: *webhookTime}, secret)
 		api.Run()
-
-	} else {
-		// commands
-		cmd.Run(client, log.New("cmd_logger"))
 	}
+
+	wg.Wait()
 }
 
 func SetupSignalHandler() (stopCh <-chan struct{}) {
@@ -112,3 +322,143 @@ func SetupSignalHandler() (stopCh <-chan struct{}) {
 
 	return stop
 }
+
+func newWebhookSender(client *http.Client, secret []byte) *webhook.Sender {
+	sender := webhook.NewSender(client, secret)
+	sender.MaxAttempts = *webhookTries
+	sender.Backoff = *webhookWait
+	return sender
+}
+
+func newICAPServer(client icap.Client, stopChan <-chan struct{}, tlsCfg *tls.Config) (*icap.Server, error) {
+	if !*icapTLS {
+		tlsCfg = nil
+	}
+	server := icap.NewServer(*icapAddr, client, stopChan, log.New("icap_logger"), tlsCfg)
+	server.Timeout = *icapTimeout
+	server.PreviewSize = *icapPreview
+	server.FailOpen = *icapFailOpen
+	if *icapBlockPage != "" {
+		page, err := template.ParseFiles(*icapBlockPage)
+		if err != nil {
+			return nil, err
+		}
+		server.BlockPage = page
+	}
+	return server, nil
+}
+
+func newProxyServer(client proxy.Client, stopChan <-chan struct{}) (*proxy.Server, error) {
+	allowCIDRs, err := fetch.ParseCIDRs(splitList(*proxyCIDRs))
+	if err != nil {
+		return nil, err
+	}
+	server := proxy.NewServer(*proxyAddr, client, stopChan, log.New("proxy_logger"))
+	server.Audit = log.New("proxy_audit")
+	server.AllowCIDRs = allowCIDRs
+	server.Timeout = *proxyTimeout
+	return server, nil
+}
+
+func newMilterServer(client milter.Client, stopChan <-chan struct{}) (*milter.Server, error) {
+	infected, err := milter.ParseAction(*milterInfected)
+	if err != nil {
+		return nil, err
+	}
+	failed, err := milter.ParseAction(*milterFailed)
+	if err != nil {
+		return nil, err
+	}
+	server := milter.NewServer(*milterAddr, client, stopChan, log.New("milter_logger"))
+	server.Policy = milter.Policy{Infected: infected, Failed: failed, Header: *milterHeader}
+	server.MaxMessageSize = *milterMaxSize
+	server.Timeout = *milterTimeout
+	return server, nil
+}
+
+func newArchiveLimits() archive.Limits {
+	return archive.Limits{
+		MaxDepth:   *archiveDepth,
+		MaxEntries: *archiveEntries,
+		MaxRatio:   *archiveRatio,
+		MaxSize:    *archiveSize << 20,
+	}
+}
+
+func newGuard() (guard *fetch.Guard, err error) {
+	guard = &fetch.Guard{
+		AllowHosts:   splitList(*urlAllowHosts),
+		DenyHosts:    splitList(*urlDenyHosts),
+		MaxRedirects: *urlRedirects,
+	}
+	if guard.AllowCIDRs, err = fetch.ParseCIDRs(splitList(*urlAllowCIDRs)); err != nil {
+		return nil, err
+	}
+	if guard.DenyCIDRs, err = fetch.ParseCIDRs(splitList(*urlDenyCIDRs)); err != nil {
+		return nil, err
+	}
+	return guard, nil
+}
+
+// newFetchers returns the registry for --file. Local files and all destinations are allowed.
+func newFetchers() *fetch.Registry {
+	fetchers := fetch.NewRegistry()
+	fetchers.Register("file", &fetch.FileFetcher{})
+	fetchers.Register("data", &fetch.DataFetcher{})
+	if s3 := newS3Fetcher(*fetchTimeout); s3 != nil {
+		fetchers.Register("s3", s3)
+	}
+
+	http := fetch.NewHTTPFetcher(nil, *fetchTimeout)
+	http.BearerToken = os.Getenv("FETCH_BEARER_TOKEN")
+	for _, h := range httpHeaders {
+		name, value, _ := strings.Cut(h, ":")
+		http.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	fetchers.Register("http", http)
+	fetchers.Register("https", http)
+	return fetchers
+}
+
+// newS3Fetcher returns the fetcher for the buckets of --fetch.s3.buckets or nil if no bucket is allowed
+func newS3Fetcher(timeout time.Duration) *fetch.S3Fetcher {
+	buckets := splitList(*s3Buckets)
+	if len(buckets) == 0 {
+		return nil
+	}
+	return &fetch.S3Fetcher{
+		Endpoint: *s3Endpoint,
+		Region:   *s3Region,
+		Buckets:  buckets,
+		Client:   &http.Client{Timeout: timeout},
+		Credentials: fetch.Credentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+}
+
+// headerFlag collects repeated header flags
+type headerFlag []string
+
+func (h *headerFlag) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlag) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header must be of the form 'Name: value'")
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+func splitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,107 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// commands of the MTA
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdMacro   = 'D'
+	cmdEOB     = 'E'
+	cmdHelo    = 'H'
+	cmdQuitNC  = 'K'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptNeg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+	cmdUnknown = 'U'
+)
+
+// responses of the milter
+const (
+	respAccept     = 'a'
+	respContinue   = 'c'
+	respDiscard    = 'd'
+	respAddHeader  = 'h'
+	respOptNeg     = 'O'
+	respQuarantine = 'q'
+	respTempFail   = 't'
+	respReplyCode  = 'y'
+)
+
+const (
+	// version is the version of the milter protocol
+	version = 6
+	// actAddHeaders and actQuarantine are the actions which the milter may perform
+	actAddHeaders = 0x01
+	actQuarantine = 0x20
+
+	// maxPacketSize limits the size of a single packet. Body chunks are at most 64KB.
+	maxPacketSize = 1 << 20
+)
+
+var errPacketTooLarge = errors.New("milter packet too large")
+
+type packet struct {
+	cmd  byte
+	data []byte
+}
+
+func readPacket(r io.Reader) (*packet, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size)
+	if n == 0 {
+		return nil, fmt.Errorf("empty milter packet")
+	}
+	if n > maxPacketSize {
+		return nil, errPacketTooLarge
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &packet{cmd: buf[0], data: buf[1:]}, nil
+}
+
+func writePacket(w io.Writer, cmd byte, data []byte) error {
+	buf := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)+1))
+	buf[4] = cmd
+	_, err := w.Write(append(buf, data...))
+	return err
+}
+
+// cstrings returns the null-terminated strings of data
+func cstrings(data []byte) []string {
+	var list []string
+	for _, b := range bytes.Split(data, []byte{0}) {
+		list = append(list, string(b))
+	}
+	if len(list) > 0 && list[len(list)-1] == "" {
+		list = list[:len(list)-1]
+	}
+	return list
+}
+
+// cstring returns the strings null-terminated and concatenated
+func cstring(list ...string) []byte {
+	var buf bytes.Buffer
+	for _, s := range list {
+		buf.WriteString(s)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,357 @@
+package milter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/clamav-facade/email"
+	"github.com/ron96G/go-common-utils/log"
+)
+
+var messagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "clamav_facade",
+	Subsystem: "milter",
+	Name:      "messages_total",
+	Help:      "Number of messages scanned by the milter by result (clean, infected, failed) and action",
+}, []string{"result", "action"})
+
+type Action string
+
+const (
+	ActionAccept     Action = "accept"
+	ActionReject     Action = "reject"
+	ActionTempFail   Action = "tempfail"
+	ActionDiscard    Action = "discard"
+	ActionQuarantine Action = "quarantine"
+	ActionAddHeader  Action = "add-header"
+)
+
+func ParseAction(s string) (Action, error) {
+	switch a := Action(s); a {
+	case ActionAccept, ActionReject, ActionTempFail, ActionDiscard, ActionQuarantine, ActionAddHeader:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown milter action %q", s)
+}
+
+// Policy decides how messages are handled
+type Policy struct {
+	// Infected is the action for messages which contain a virus
+	Infected Action
+	// Failed is the action for messages which could not be scanned
+	Failed Action
+	// Header is added by ActionAddHeader. If any action adds the header, it is also added to clean messages.
+	Header string
+}
+
+var DefaultPolicy = Policy{
+	Infected: ActionReject,
+	Failed:   ActionTempFail,
+	Header:   "X-Virus-Status",
+}
+
+// Client is the part of the clamav client which is used by the server
+type Client interface {
+	Scan(context.Context, io.Reader) (*clamav.ScanResult, error)
+	MaxFilesize() int
+}
+
+// Server is a milter (sendmail/postfix mail filter) which scans every part of a message
+type Server struct {
+	// Addr is a tcp address or a unix socket of the form 'unix:///run/milter.sock'
+	Addr     string
+	Log      log.Logger
+	StopChan <-chan struct{}
+	client   Client
+	listener net.Listener
+	Policy   Policy
+	// MaxMessageSize is the maximum size of a message. Larger messages are handled like failed scans.
+	MaxMessageSize int
+	// Timeout is the maximum duration of the scan of a message
+	Timeout time.Duration
+	// IdleTimeout is the maximum duration the server waits for the next command of the MTA
+	IdleTimeout time.Duration
+}
+
+func NewServer(addr string, client Client, stopChan <-chan struct{}, logger log.Logger) *Server {
+	return &Server{
+		Addr:           addr,
+		Log:            logger,
+		StopChan:       stopChan,
+		client:         client,
+		Policy:         DefaultPolicy,
+		MaxMessageSize: 50 << 20,
+		Timeout:        5 * time.Minute,
+		IdleTimeout:    5 * time.Minute,
+	}
+}
+
+func (s *Server) ToString() string {
+	return fmt.Sprintf(
+		"addr='%s', infected='%s', failed='%s', max_message_size='%d', timeout='%s'",
+		s.Addr, s.Policy.Infected, s.Policy.Failed, s.MaxMessageSize, s.Timeout,
+	)
+}
+
+// Listen opens the listener of the server. It is called by Run if the listener is not open yet.
+func (s *Server) Listen() (err error) {
+	network, address, err := clamav.ParseAddress(s.Addr)
+	if err != nil {
+		return err
+	}
+	s.listener, err = net.Listen(network, address)
+	return err
+}
+
+// Run serves connections until the StopChan is closed
+func (s *Server) Run() {
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
+			s.Log.Error("failed to open port", "error", err, "addr", s.Addr)
+			return
+		}
+	}
+
+	go func() {
+		s.Log.Debug(s.ToString())
+		s.Log.Info("Starting milter", "addr", s.Addr)
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				s.Log.Warn("Failed to accept connection", "error", err)
+				continue
+			}
+			go s.serveConn(conn)
+		}
+	}()
+
+	//  handle shutdown
+	<-s.StopChan
+
+	s.Log.Warn("Shutting down milter")
+	if err := s.listener.Close(); err != nil {
+		s.Log.Error("milter shutdown failed", "error", err)
+	}
+}
+
+// message is the message which is currently received
+type message struct {
+	queueID  string
+	data     bytes.Buffer
+	tooLarge bool
+}
+
+func (m *message) write(s *Server, p []byte) {
+	if m.tooLarge || s.MaxMessageSize > 0 && m.data.Len()+len(p) > s.MaxMessageSize {
+		m.tooLarge = true
+		m.data.Reset()
+		return
+	}
+	m.data.Write(p)
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	msg := &message{}
+	// actions are the actions the MTA granted during the option negotiation
+	var actions uint32
+
+	for {
+		if s.IdleTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		pkt, err := readPacket(conn)
+		if err != nil {
+			if err != io.EOF {
+				s.Log.Warn("Failed to read milter packet", "error", err, "remote", conn.RemoteAddr().String())
+			}
+			return
+		}
+
+		switch pkt.cmd {
+		case cmdOptNeg:
+			if len(pkt.data) < 12 {
+				s.Log.Warn("Invalid option negotiation", "remote", conn.RemoteAddr().String())
+				return
+			}
+			actions = binary.BigEndian.Uint32(pkt.data[4:8]) & (actAddHeaders | actQuarantine)
+			reply := make([]byte, 12)
+			binary.BigEndian.PutUint32(reply[0:4], version)
+			binary.BigEndian.PutUint32(reply[4:8], actions)
+			// all steps are requested and replied
+			binary.BigEndian.PutUint32(reply[8:12], 0)
+			err = writePacket(conn, respOptNeg, reply)
+
+		case cmdMacro:
+			// macros are not replied
+			if len(pkt.data) > 0 {
+				values := cstrings(pkt.data[1:])
+				for i := 0; i+1 < len(values); i += 2 {
+					if values[i] == "i" || values[i] == "{i}" {
+						msg.queueID = values[i+1]
+					}
+				}
+			}
+
+		case cmdMail:
+			msg = &message{queueID: msg.queueID}
+			err = writePacket(conn, respContinue, nil)
+
+		case cmdHeader:
+			fields := cstrings(pkt.data)
+			if len(fields) == 2 {
+				value := fields[1]
+				if !strings.HasPrefix(value, " ") && !strings.HasPrefix(value, "\t") {
+					value = " " + value
+				}
+				msg.write(s, []byte(fields[0]+":"+value+"\r\n"))
+			}
+			err = writePacket(conn, respContinue, nil)
+
+		case cmdEOH:
+			msg.write(s, []byte("\r\n"))
+			err = writePacket(conn, respContinue, nil)
+
+		case cmdBody:
+			msg.write(s, pkt.data)
+			err = writePacket(conn, respContinue, nil)
+
+		case cmdEOB:
+			msg.write(s, pkt.data)
+			err = s.endOfMessage(conn, msg, actions)
+			msg = &message{}
+
+		case cmdAbort:
+			// the message is aborted, the connection is reused
+			msg = &message{}
+
+		case cmdQuitNC:
+			msg = &message{}
+
+		case cmdQuit:
+			return
+
+		default:
+			// connect, helo, rcpt, data and unknown commands
+			err = writePacket(conn, respContinue, nil)
+		}
+
+		if err != nil {
+			s.Log.Warn("Failed to write milter packet", "error", err, "remote", conn.RemoteAddr().String())
+			return
+		}
+	}
+}
+
+// endOfMessage scans the message and replies according to the policy.
+// Actions which the MTA did not grant are skipped, a quarantine falls back to a rejection.
+func (s *Server) endOfMessage(conn net.Conn, msg *message, actions uint32) error {
+	start := time.Now()
+	signatures, err := s.scanMessage(msg)
+
+	result, action := "clean", ActionAccept
+	switch {
+	case err != nil:
+		result, action = "failed", s.Policy.Failed
+	case len(signatures) > 0:
+		result, action = "infected", s.Policy.Infected
+	}
+	if action == ActionQuarantine && actions&actQuarantine == 0 {
+		action = ActionReject
+	}
+	messagesTotal.WithLabelValues(result, string(action)).Inc()
+
+	fields := []interface{}{"queue_id", msg.queueID, "result", result, "action", action, "elapsed_time", time.Since(start).Milliseconds()}
+	switch {
+	case err != nil:
+		s.Log.Warn("Failed to scan message", append(fields, "error", err)...)
+	case len(signatures) > 0:
+		s.Log.Warn("Message contains a virus", append(fields, "signatures", signatures)...)
+	default:
+		s.Log.Info("Scanned message", fields...)
+	}
+
+	status, reason := "Clean", ""
+	if err != nil {
+		status, reason = "Unscanned", "virus scan failed"
+	} else if len(signatures) > 0 {
+		status, reason = "Infected ("+strings.Join(signatures, ", ")+")", "message contains a virus: "+strings.Join(signatures, ", ")
+	}
+
+	// the header is useless if the message is not delivered
+	delivered := action != ActionReject && action != ActionTempFail && action != ActionDiscard
+	addHeader := s.Policy.Infected == ActionAddHeader || s.Policy.Failed == ActionAddHeader
+	if delivered && addHeader && actions&actAddHeaders != 0 {
+		if err := writePacket(conn, respAddHeader, cstring(s.Policy.Header, status)); err != nil {
+			return err
+		}
+	}
+
+	switch action {
+	case ActionReject:
+		code := "550 5.7.1"
+		if err != nil {
+			code = "451 4.3.0"
+		}
+		return writePacket(conn, respReplyCode, cstring(code+" "+reason))
+	case ActionTempFail:
+		return writePacket(conn, respTempFail, nil)
+	case ActionDiscard:
+		return writePacket(conn, respDiscard, nil)
+	case ActionQuarantine:
+		if err := writePacket(conn, respQuarantine, cstring(reason)); err != nil {
+			return err
+		}
+	}
+	return writePacket(conn, respAccept, nil)
+}
+
+// scanMessage scans every part of the message. If it is not valid MIME, the message is scanned as a whole.
+func (s *Server) scanMessage(msg *message) (signatures []string, err error) {
+	if msg.tooLarge {
+		return nil, clamav.ErrFileTooLarge
+	}
+
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	var scanErr error
+	walkErr := email.Walk(bytes.NewReader(msg.data.Bytes()), func(part *email.Part) error {
+		res, err := s.client.Scan(ctx, clamav.LimitReader(part.Body, s.client.MaxFilesize()))
+		if err != nil {
+			scanErr = fmt.Errorf("failed to scan part %s: %w", part.Path, err)
+			return scanErr
+		}
+		if res.Infected() {
+			signatures = append(signatures, res.Signatures...)
+		}
+		return nil
+	})
+	if scanErr != nil || walkErr == nil {
+		return signatures, scanErr
+	}
+
+	s.Log.Warn("Failed to parse message, scanning it as a whole", "queue_id", msg.queueID, "error", walkErr)
+	res, err := s.client.Scan(ctx, clamav.LimitReader(bytes.NewReader(msg.data.Bytes()), s.client.MaxFilesize()))
+	if err != nil {
+		return nil, err
+	}
+	return res.Signatures, nil
+}
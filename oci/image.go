@@ -0,0 +1,260 @@
+package oci
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxJSONSize limits the size of the manifests and configs of an image
+const maxJSONSize = 4 << 20
+
+// maxIndexDepth is the maximum number of nested indexes below index.json
+const maxIndexDepth = 8
+
+const (
+	mediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerIndex = "application/vnd.docker.distribution.manifest.list.v2+json"
+	annotationRefName    = "org.opencontainers.image.ref.name"
+)
+
+var ErrInvalidImage = errors.New("invalid image")
+
+// Layer is a layer of an image in the order in which the layers are applied
+type Layer struct {
+	// Digest identifies the layer. It is the path within the tarball if the digest is unknown.
+	Digest string
+	name   string
+}
+
+// Image is a tarball of `docker save` or an OCI image layout.
+// Only the first image of a tarball with multiple images is read.
+type Image struct {
+	Tags   []string
+	Layers []Layer
+	f      *os.File
+	// entries are the sections of the files of the tarball by their name
+	entries map[string]*io.SectionReader
+}
+
+// Open reads the manifest of the image tarball at filename
+func Open(filename string) (*Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{f: f, entries: map[string]*io.SectionReader{}}
+	if err := img.index(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, ok := img.entries["manifest.json"]; ok {
+		err = img.readDockerManifest()
+	} else if _, ok := img.entries["index.json"]; ok {
+		err = img.readOCIIndex("index.json")
+	} else {
+		err = fmt.Errorf("%w: neither manifest.json nor index.json found", ErrInvalidImage)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func (img *Image) Close() error {
+	return img.f.Close()
+}
+
+// index records the position of every file of the tarball. The tar reader does not
+// buffer, so the content of an entry starts at the offset after its header.
+func (img *Image) index() error {
+	counter := &offsetReader{r: img.f}
+	tr := tar.NewReader(counter)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidImage, err)
+		}
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			img.entries[cleanPath(hdr.Name)] = io.NewSectionReader(img.f, counter.n, hdr.Size)
+		}
+	}
+}
+
+// open returns the content of a file of the tarball
+func (img *Image) open(name string) (*io.SectionReader, error) {
+	section, ok := img.entries[cleanPath(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s not found", ErrInvalidImage, name)
+	}
+	return io.NewSectionReader(section, 0, section.Size()), nil
+}
+
+func (img *Image) readJSON(name string, v interface{}) error {
+	r, err := img.open(name)
+	if err != nil {
+		return err
+	}
+	if r.Size() > maxJSONSize {
+		return fmt.Errorf("%w: %s is too large", ErrInvalidImage, name)
+	}
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("%w: failed to decode %s: %s", ErrInvalidImage, name, err)
+	}
+	return nil
+}
+
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+type dockerConfig struct {
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+func (img *Image) readDockerManifest() error {
+	var manifests []dockerManifest
+	if err := img.readJSON("manifest.json", &manifests); err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		return fmt.Errorf("%w: manifest.json contains no image", ErrInvalidImage)
+	}
+	manifest := manifests[0]
+	img.Tags = manifest.RepoTags
+
+	// older versions of docker name the layers by their own id, the diff ids of the config are the digests
+	config := dockerConfig{}
+	if manifest.Config != "" {
+		if err := img.readJSON(manifest.Config, &config); err != nil {
+			return err
+		}
+	}
+	for i, name := range manifest.Layers {
+		layer := Layer{Digest: blobDigest(name), name: name}
+		if layer.Digest == "" && len(config.RootFS.DiffIDs) == len(manifest.Layers) {
+			layer.Digest = config.RootFS.DiffIDs[i]
+		}
+		if layer.Digest == "" {
+			layer.Digest = name
+		}
+		img.Layers = append(img.Layers, layer)
+	}
+	return nil
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Layers []descriptor `json:"layers"`
+}
+
+// readOCIIndex reads the first manifest of the index. Nested indexes, e.g. of multi-platform images, are descended
+// up to maxIndexDepth levels.
+func (img *Image) readOCIIndex(name string) error {
+	visited := map[string]bool{}
+	for depth := 0; ; depth++ {
+		if visited[name] {
+			return fmt.Errorf("%w: indexes form a cycle at %s", ErrInvalidImage, name)
+		}
+		if depth > maxIndexDepth {
+			return fmt.Errorf("%w: indexes are nested deeper than %d levels", ErrInvalidImage, maxIndexDepth)
+		}
+		visited[name] = true
+
+		index := ociIndex{}
+		if err := img.readJSON(name, &index); err != nil {
+			return err
+		}
+		if len(index.Manifests) == 0 {
+			return fmt.Errorf("%w: %s contains no manifest", ErrInvalidImage, name)
+		}
+		desc := index.Manifests[0]
+		if ref := desc.Annotations[annotationRefName]; ref != "" && img.Tags == nil {
+			img.Tags = []string{ref}
+		}
+
+		blob, err := blobPath(desc.Digest)
+		if err != nil {
+			return err
+		}
+		if desc.MediaType == mediaTypeOCIIndex || desc.MediaType == mediaTypeDockerIndex {
+			name = blob
+			continue
+		}
+		return img.readOCIManifest(blob)
+	}
+}
+
+// readOCIManifest reads the layers of the manifest
+func (img *Image) readOCIManifest(name string) error {
+	manifest := ociManifest{}
+	if err := img.readJSON(name, &manifest); err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		blob, err := blobPath(layer.Digest)
+		if err != nil {
+			return err
+		}
+		img.Layers = append(img.Layers, Layer{Digest: layer.Digest, name: blob})
+	}
+	return nil
+}
+
+// blobPath returns the path of a blob of an OCI image layout
+func blobPath(digest string) (string, error) {
+	algorithm, hex, ok := strings.Cut(digest, ":")
+	if !ok || algorithm == "" || hex == "" || strings.ContainsAny(digest, "/.") {
+		return "", fmt.Errorf("%w: invalid digest %q", ErrInvalidImage, digest)
+	}
+	return "blobs/" + algorithm + "/" + hex, nil
+}
+
+// blobDigest returns the digest of a blob path or an empty string if the path is not a blob
+func blobDigest(name string) string {
+	parts := strings.Split(cleanPath(name), "/")
+	if len(parts) != 3 || parts[0] != "blobs" {
+		return ""
+	}
+	return parts[1] + ":" + parts[2]
+}
+
+// cleanPath returns the path relative to the root without leading './' or '/'
+func cleanPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+type offsetReader struct {
+	r io.Reader
+	n int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,179 @@
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/ron96G/clamav-facade/clamav"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// Client is the part of the clamav client which is used to scan the files of an image
+type Client interface {
+	Scan(context.Context, io.Reader) (*clamav.ScanResult, error)
+	MaxFilesize() int
+}
+
+// Report is the result of the scan of an image
+type Report struct {
+	Image    string    `json:"image"`
+	Tags     []string  `json:"tags,omitempty"`
+	Layers   int       `json:"layers"`
+	Scanned  int       `json:"scanned_files"`
+	Findings []Finding `json:"findings"`
+	Failures []Finding `json:"failures"`
+}
+
+// Finding is an infected file or a file which could not be scanned
+type Finding struct {
+	Path string `json:"path"`
+	// Layer is the digest of the layer which contains the file
+	Layer      string   `json:"layer"`
+	Signatures []string `json:"signatures,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Failed returns whether the image contains a virus or files could not be scanned
+func (r *Report) Failed() bool {
+	return len(r.Findings) > 0 || len(r.Failures) > 0
+}
+
+// filesystem records the files of the upper layers which hide the files of the lower layers
+type filesystem struct {
+	// entries are the paths of the upper layers and whether they are directories
+	entries   map[string]bool
+	whiteouts map[string]bool
+	opaque    map[string]bool
+}
+
+func newFilesystem() *filesystem {
+	return &filesystem{entries: map[string]bool{}, whiteouts: map[string]bool{}, opaque: map[string]bool{}}
+}
+
+// visible returns whether a file of a lower layer is part of the image
+func (fs *filesystem) visible(name string) bool {
+	if _, ok := fs.entries[name]; ok || fs.whiteouts[name] {
+		// overwritten or deleted
+		return false
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		isDir, ok := fs.entries[dir]
+		if fs.whiteouts[dir] || fs.opaque[dir] || ok && !isDir {
+			return false
+		}
+	}
+	return true
+}
+
+// merge adds the files of a layer to the upper layers
+func (fs *filesystem) merge(layer *filesystem) {
+	for name, isDir := range layer.entries {
+		fs.entries[name] = isDir
+	}
+	for name := range layer.whiteouts {
+		fs.whiteouts[name] = true
+	}
+	for name := range layer.opaque {
+		fs.opaque[name] = true
+	}
+}
+
+// Scan streams every regular file of the image to clamav. Files which are deleted or overwritten
+// by an upper layer are not scanned. The layers are read from the top, so the files of a layer
+// are known before the lower layers are read.
+func (img *Image) Scan(ctx context.Context, client Client) (*Report, error) {
+	report := &Report{Image: img.f.Name(), Tags: img.Tags, Layers: len(img.Layers), Findings: []Finding{}, Failures: []Finding{}}
+	upper := newFilesystem()
+
+	for i := len(img.Layers) - 1; i >= 0; i-- {
+		layer, err := img.scanLayer(ctx, client, img.Layers[i], upper, report)
+		if err != nil {
+			return report, fmt.Errorf("failed to read layer %s: %w", img.Layers[i].Digest, err)
+		}
+		upper.merge(layer)
+	}
+	return report, nil
+}
+
+func (img *Image) scanLayer(ctx context.Context, client Client, layer Layer, upper *filesystem, report *Report) (*filesystem, error) {
+	blob, err := img.open(layer.name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decompress(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	files := newFilesystem()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := cleanPath(hdr.Name)
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+		switch {
+		case name == "":
+			continue
+		case base == opaqueWhiteout:
+			files.opaque[dir] = true
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			files.whiteouts[path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))] = true
+			continue
+		}
+		files.entries[name] = hdr.Typeflag == tar.TypeDir
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA || !upper.visible(name) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		report.Scanned++
+		res, err := client.Scan(ctx, clamav.LimitReader(tr, client.MaxFilesize()))
+		var replyErr *clamav.ReplyError
+		switch {
+		case errors.Is(err, clamav.ErrFileTooLarge), errors.As(err, &replyErr):
+			// the file is rejected, the remaining files can still be scanned
+			report.Failures = append(report.Failures, Finding{Path: "/" + name, Layer: layer.Digest, Error: err.Error()})
+		case err != nil:
+			return nil, fmt.Errorf("failed to scan /%s: %w", name, err)
+		case res.Infected():
+			report.Findings = append(report.Findings, Finding{Path: "/" + name, Layer: layer.Digest, Signatures: res.Signatures})
+		}
+	}
+}
+
+// decompress removes the compression of a layer. Layers are either uncompressed or gzip compressed.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, fmt.Errorf("%w: zstd compressed layers are not supported", ErrInvalidImage)
+	}
+	return br, nil
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	commandsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clamav_facade",
+		Subsystem: "proxy",
+		Name:      "commands_total",
+		Help:      "Number of commands of clamd clients by command and result (ok, infected, error, unknown)",
+	}, []string{"command", "result"})
+	commandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "clamav_facade",
+		Subsystem: "proxy",
+		Name:      "command_duration_seconds",
+		Help:      "Duration of the commands of clamd clients including the scan",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command"})
+	scannedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "clamav_facade",
+		Subsystem: "proxy",
+		Name:      "scanned_bytes_total",
+		Help:      "Number of bytes which were scanned for clamd clients",
+	})
+	activeConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "clamav_facade",
+		Subsystem: "proxy",
+		Name:      "connections",
+		Help:      "Number of open connections of clamd clients",
+	})
+	rejectedConnections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "clamav_facade",
+		Subsystem: "proxy",
+		Name:      "rejected_connections_total",
+		Help:      "Number of connections which were rejected since their source is not allowed",
+	})
+)
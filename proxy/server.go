@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/go-common-utils/log"
+)
+
+const (
+	// rejectTimeout is the time a rejected connection is kept open to reply
+	rejectTimeout = time.Second
+	// rejectDrainSize is the maximum input which is read from a rejected connection
+	rejectDrainSize = 64 << 10
+)
+
+// Client is the part of the clamav client which is used by the server
+type Client interface {
+	Scan(context.Context, io.Reader) (*clamav.ScanResult, error)
+	Version(ctx context.Context) (*clamav.VersionInfo, error)
+	Ping(ctx context.Context) error
+	MaxFilesize() int
+}
+
+// Server speaks the clamd protocol and forwards the commands to the client.
+// PING, VERSION and INSTREAM are supported, also within an IDSESSION.
+type Server struct {
+	// Addr is a tcp address or a unix socket of the form 'unix:///run/clamav/clamd.ctl'
+	Addr string
+	Log  log.Logger
+	// Audit logs every command with its source and result
+	Audit    log.Logger
+	StopChan <-chan struct{}
+	client   Client
+	listener net.Listener
+	// AllowCIDRs are the networks which can connect. If it is empty, all sources are allowed.
+	// Connections of unix sockets are always allowed.
+	AllowCIDRs []*net.IPNet
+	// Timeout is the maximum duration of a command including the scan
+	Timeout time.Duration
+	// IdleTimeout is the maximum duration a connection waits for the next command
+	IdleTimeout time.Duration
+}
+
+func NewServer(addr string, client Client, stopChan <-chan struct{}, logger log.Logger) *Server {
+	return &Server{
+		Addr:        addr,
+		Log:         logger,
+		Audit:       logger,
+		StopChan:    stopChan,
+		client:      client,
+		Timeout:     time.Minute,
+		IdleTimeout: 30 * time.Second,
+	}
+}
+
+func (s *Server) ToString() string {
+	return fmt.Sprintf(
+		"addr='%s', timeout='%s', idle_timeout='%s', allowed_cidrs='%v'",
+		s.Addr, s.Timeout, s.IdleTimeout, s.AllowCIDRs,
+	)
+}
+
+// Listen opens the listener of the server. It is called by Run if the listener is not open yet.
+func (s *Server) Listen() (err error) {
+	network, address, err := clamav.ParseAddress(s.Addr)
+	if err != nil {
+		return err
+	}
+	s.listener, err = net.Listen(network, address)
+	return err
+}
+
+// Run serves connections until the StopChan is closed
+func (s *Server) Run() {
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
+			s.Log.Error("failed to open port", "error", err, "addr", s.Addr)
+			return
+		}
+	}
+
+	go func() {
+		s.Log.Debug(s.ToString())
+		s.Log.Info("Starting clamd proxy", "addr", s.Addr)
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				s.Log.Warn("Failed to accept connection", "error", err)
+				continue
+			}
+			go s.serveConn(conn)
+		}
+	}()
+
+	//  handle shutdown
+	<-s.StopChan
+
+	s.Log.Warn("Shutting down clamd proxy")
+	if err := s.listener.Close(); err != nil {
+		s.Log.Error("clamd proxy shutdown failed", "error", err)
+	}
+}
+
+// allowed returns whether the source of the connection is allowed
+func (s *Server) allowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || len(s.AllowCIDRs) == 0 {
+		return true
+	}
+	for _, n := range s.AllowCIDRs {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	if !s.allowed(conn.RemoteAddr()) {
+		rejectedConnections.Inc()
+		s.Audit.Warn("Rejected connection", "remote", remote)
+		s.reject(conn)
+		return
+	}
+	activeConnections.Inc()
+	defer activeConnections.Dec()
+
+	r := bufio.NewReader(conn)
+	s.setDeadline(conn, s.IdleTimeout)
+	cmd, err := clamav.ReadCommand(r)
+	if err != nil {
+		s.Log.Debug("Failed to read command", "remote", remote, "error", err)
+		return
+	}
+
+	if cmd.Name == "IDSESSION" {
+		s.serveSession(conn, r)
+		return
+	}
+	s.setDeadline(conn, s.Timeout)
+	reply, _ := s.execute(remote, cmd, r)
+	conn.Write([]byte(reply + string(cmd.Delimiter)))
+}
+
+// reject replies to the first command of a connection which is not allowed with an error.
+// Afterwards the remaining input is drained for a short time, since closing the connection
+// with unread data resets it and the client might not receive the reply.
+func (s *Server) reject(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	r := io.LimitReader(conn, rejectDrainSize)
+	cmd, err := clamav.ReadCommand(bufio.NewReader(r))
+	if err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte(fmt.Sprintf("%s: Access denied. ERROR%c", cmd.Name, cmd.Delimiter))); err != nil {
+		return
+	}
+	if v, ok := conn.(interface{ CloseWrite() error }); ok {
+		v.CloseWrite()
+	}
+	io.Copy(io.Discard, r)
+}
+
+// serveSession replies to the commands of an IDSESSION in order until it is ended
+func (s *Server) serveSession(conn net.Conn, r *bufio.Reader) {
+	remote := conn.RemoteAddr().String()
+	for id := 1; ; id++ {
+		s.setDeadline(conn, s.IdleTimeout)
+		cmd, err := clamav.ReadCommand(r)
+		if err != nil || cmd.Name == "END" {
+			return
+		}
+
+		s.setDeadline(conn, s.Timeout)
+		reply, ok := s.execute(remote, cmd, r)
+		if _, err := conn.Write([]byte(fmt.Sprintf("%d: %s%c", id, reply, cmd.Delimiter))); err != nil || !ok {
+			return
+		}
+	}
+}
+
+func (s *Server) setDeadline(conn net.Conn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+}
+
+// execute forwards the command to the client and returns the reply.
+// If ok is false, the connection must be closed after the reply.
+func (s *Server) execute(remote string, cmd *clamav.Command, r io.Reader) (reply string, ok bool) {
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	// the label of unknown commands is fixed to limit the cardinality of the metrics
+	label, result, signature, size := cmd.Name, "ok", "", int64(0)
+	var err error
+
+	switch cmd.Name {
+	case "PING":
+		if err = s.client.Ping(ctx); err == nil {
+			reply, ok = "PONG", true
+		}
+
+	case "VERSION":
+		var info *clamav.VersionInfo
+		if info, err = s.client.Version(ctx); err == nil {
+			reply, ok = strings.TrimRight(info.Raw, "\000\n"), true
+		}
+
+	case "INSTREAM":
+		stream := clamav.NewStreamReader(r)
+		var res *clamav.ScanResult
+		res, err = s.client.Scan(ctx, clamav.LimitReader(stream, s.client.MaxFilesize()))
+		// the next command can only be read if the stream was consumed
+		ok = stream.Complete()
+		if err == nil {
+			size = res.Size
+			scannedBytes.Add(float64(size))
+			reply = "stream: OK"
+			if res.Infected() {
+				result, signature = "infected", res.Signature()
+				lines := make([]string, len(res.Signatures))
+				for i, sig := range res.Signatures {
+					lines[i] = "stream: " + sig + " FOUND"
+				}
+				reply = strings.Join(lines, string(cmd.Delimiter))
+			}
+		}
+
+	default:
+		label, result, reply = "UNKNOWN", "unknown", "UNKNOWN COMMAND"
+	}
+
+	if err != nil {
+		result, ok = "error", false
+		reply = errorReply(err)
+	}
+
+	elapsed := time.Since(start)
+	commandsTotal.WithLabelValues(label, result).Inc()
+	commandDuration.WithLabelValues(label).Observe(elapsed.Seconds())
+
+	fields := []interface{}{"remote", remote, "command", cmd.Name, "result", result, "elapsed_time", elapsed.Milliseconds()}
+	if cmd.Name == "INSTREAM" {
+		fields = append(fields, "size", size, "signature", signature)
+	}
+	if err != nil {
+		s.Audit.Warn("Failed command", append(fields, "error", err)...)
+	} else {
+		s.Audit.Info("Executed command", fields...)
+	}
+	return reply, ok
+}
+
+// errorReply returns the reply of clamd for err
+func errorReply(err error) string {
+	var replyErr *clamav.ReplyError
+	switch {
+	case errors.Is(err, clamav.ErrFileTooLarge):
+		return "INSTREAM size limit exceeded. ERROR"
+	case errors.As(err, &replyErr):
+		return replyErr.Message + ". ERROR"
+	}
+	return "Service unavailable. ERROR"
+}
@@ -1,16 +1,29 @@
 package tests
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	echo "github.com/labstack/echo/v4"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"github.com/ron96G/clamav-facade/api"
+	apipkg "github.com/ron96G/clamav-facade/api"
 	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/clamav-facade/fetch"
+	"github.com/ron96G/clamav-facade/webhook"
 	"github.com/ron96G/go-common-utils/log"
 )
 
@@ -24,14 +37,20 @@ var _ = Describe("API", func() {
 
 	log.Configure("debug", "json", os.Stdout)
 	mock := NewMockServer("localhost", 33100)
+	if err := mock.Listen(); err != nil {
+		panic(err)
+	}
 	go mock.Run()
+	mock.Expect(VERSION, 1, RETURN_OK)
 
 	randomFile := GenerateRandomReader(4096)
 
 	client, _ := clamav.NewClamavClient("localhost", 33100, time.Second*10)
 	client.SetMaxSize(4096)
+	client.ScanVersion = true
 	stopChan := make(chan struct{})
-	api := api.NewAPI("", "localhost:32123", client, stopChan, log.New("api_logger"), nil)
+	api := apipkg.NewAPI("", "localhost:32123", client, stopChan, log.New("api_logger"), nil)
+	loopback, _ := fetch.ParseCIDRs([]string{"127.0.0.0/8"})
 
 	Describe("Scan Fails", func() {
 		Describe("Due to wrong content-type", func() {
@@ -72,7 +91,23 @@ var _ = Describe("API", func() {
 				Expect(err).To(BeNil())
 				Expect(rec.Code).To(Equal(http.StatusBadGateway))
 				Expect(rec.Body.String()).To(ContainSubstring("\"status\":\"failed\""))
-				Expect(rec.Body.String()).To(ContainSubstring("failed to read response"))
+				Expect(rec.Body.String()).To(ContainSubstring("clamav returned an empty reply"))
+			})
+		})
+
+		Describe("Due to clamav error reply", func() {
+			mock.Expect(INSTREAM, 1, RETURN_ERROR)
+			c, rec, err := NewEchoMultipartFileContext(http.MethodPost, "/scan", GenerateRandomReader(1024))
+			if err != nil {
+				Fail(err.Error())
+			}
+			err = api.Scan(c)
+			It("Should fail and not report a virus", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusBadGateway))
+				Expect(rec.Body.String()).To(ContainSubstring("\"status\":\"failed\""))
+				Expect(rec.Body.String()).To(ContainSubstring("INSTREAM size limit exceeded"))
+				Expect(rec.Body.String()).NotTo(ContainSubstring("file contains a virus"))
 			})
 		})
 	})
@@ -90,6 +125,7 @@ var _ = Describe("API", func() {
 				Expect(rec.Code).To(Equal(http.StatusOK))
 				Expect(rec.Body.String()).To(ContainSubstring("\"status\":\"success\""))
 				Expect(rec.Body.String()).To(ContainSubstring("file does not contains a virus"))
+				Expect(rec.Body.String()).To(ContainSubstring("\"database\":26820"))
 			})
 		})
 
@@ -105,6 +141,594 @@ var _ = Describe("API", func() {
 				Expect(rec.Code).To(Equal(http.StatusOK))
 				Expect(rec.Body.String()).To(ContainSubstring("\"status\":\"virus\""))
 				Expect(rec.Body.String()).To(ContainSubstring("file contains a virus"))
+				Expect(rec.Body.String()).To(ContainSubstring(VIRUS_SIGNATURE))
+			})
+		})
+	})
+
+	Describe("Scan Streaming", func() {
+		// upload returns a request whose multipart body is written by the returned writer
+		upload := func() (echo.Context, *httptest.ResponseRecorder, *multipart.Writer, *io.PipeWriter) {
+			pr, pw := io.Pipe()
+			writer := multipart.NewWriter(pw)
+			req := httptest.NewRequest(http.MethodPost, "/scan", pr)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			c, rec := NewEchoContext(req)
+			return c, rec, writer, pw
+		}
+
+		It("Should send the file before it is fully uploaded", func() {
+			mock.Expect(INSTREAM, 1, RETURN_OK)
+			c, rec, writer, pw := upload()
+			done := make(chan error)
+			go func() { done <- api.Scan(c) }()
+
+			streamed := mock.Streamed()
+			part, _ := writer.CreateFormFile("file", "filename")
+			part.Write(make([]byte, 3000))
+			Eventually(mock.Streamed).Should(BeNumerically(">", streamed))
+
+			part.Write(make([]byte, 1000))
+			writer.Close()
+			pw.Close()
+			Expect(<-done).To(BeNil())
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(mock.Streamed() - streamed).To(BeEquivalentTo(4000))
+		})
+
+		It("Should cut off files exceeding the limit", func() {
+			c, rec, writer, pw := upload()
+			streamed := mock.Streamed()
+			go func() {
+				part, _ := writer.CreateFormFile("file", "filename")
+				for i := 0; i < 16; i++ {
+					if _, err := part.Write(make([]byte, 1024)); err != nil {
+						return
+					}
+				}
+				writer.Close()
+				pw.Close()
+			}()
+
+			Expect(api.Scan(c)).To(BeNil())
+			pw.CloseWithError(io.ErrClosedPipe)
+			Expect(rec.Code).To(Equal(http.StatusBadRequest))
+			Expect(rec.Body.String()).To(ContainSubstring("file size limit exceeded"))
+			Consistently(mock.Streamed, 200*time.Millisecond).Should(BeNumerically("<=", streamed+4096))
+		})
+	})
+
+	Describe("Scan Broken Upload", func() {
+		It("Should blame the client if the upload breaks off", func() {
+			pr, pw := io.Pipe()
+			writer := multipart.NewWriter(pw)
+			req := httptest.NewRequest(http.MethodPost, "/scan", pr)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			c, rec := NewEchoContext(req)
+			go func() {
+				part, _ := writer.CreateFormFile("file", "filename")
+				part.Write(make([]byte, 1024))
+				pw.CloseWithError(errors.New("connection reset by client"))
+			}()
+
+			Expect(api.Scan(c)).To(BeNil())
+			Expect(rec.Code).To(Equal(http.StatusBadRequest))
+			Expect(rec.Body.String()).To(ContainSubstring(apipkg.ErrCodeInvalidRequest))
+			Expect(rec.Body.String()).NotTo(ContainSubstring(apipkg.ErrCodeClamavError))
+		})
+	})
+
+	Describe("Scan Multiple Files", func() {
+		mock.Expect(INSTREAM, 1, RETURN_OK)
+		content := []byte("first file")
+		req, err := NewMultipartFilesRequest(http.MethodPost, "/scan", "files",
+			[]string{"first.txt", "second.bin"},
+			[]io.Reader{bytes.NewReader(content), GenerateRandomReader(4097)},
+		)
+		if err != nil {
+			Fail(err.Error())
+		}
+		c, rec := NewEchoContext(req)
+		err = api.Scan(c)
+		It("Should report each file of the field in order", func() {
+			Expect(err).To(BeNil())
+			Expect(rec.Code).To(Equal(http.StatusMultiStatus))
+
+			resp := struct {
+				Results []struct {
+					ID       string `json:"id"`
+					Status   string `json:"status"`
+					Filename string `json:"filename"`
+					Size     int64  `json:"size"`
+					SHA256   string `json:"sha256"`
+				} `json:"results"`
+			}{}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+			Expect(resp.Results).To(HaveLen(2))
+
+			sum := sha256.Sum256(content)
+			Expect(resp.Results[0].ID).To(Equal("files"))
+			Expect(resp.Results[0].Filename).To(Equal("first.txt"))
+			Expect(resp.Results[0].Status).To(Equal("success"))
+			Expect(resp.Results[0].Size).To(Equal(int64(len(content))))
+			Expect(resp.Results[0].SHA256).To(Equal(hex.EncodeToString(sum[:])))
+
+			Expect(resp.Results[1].Filename).To(Equal("second.bin"))
+			Expect(resp.Results[1].Status).To(Equal("failed"))
+		})
+	})
+
+	Describe("Scan Raw", func() {
+		newRequest := func(contentType string, body io.Reader) (echo.Context, *httptest.ResponseRecorder) {
+			req := httptest.NewRequest(http.MethodPost, "/scan/raw", body)
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("X-Filename", "raw.bin")
+			return NewEchoContext(req)
+		}
+
+		Describe("With no virus", func() {
+			mock.Expect(INSTREAM, 1, RETURN_OK)
+			c, rec := newRequest("application/octet-stream", GenerateRandomReader(1024))
+			err := api.ScanRaw(c)
+			It("Should succeed", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusOK))
+				Expect(rec.Body.String()).To(ContainSubstring("\"status\":\"success\""))
+				Expect(rec.Body.String()).To(ContainSubstring("\"filename\":\"raw.bin\""))
+				Expect(rec.Body.String()).To(ContainSubstring("\"size\":1024"))
+			})
+		})
+
+		Describe("With declared length exceeding the limit", func() {
+			c, rec := newRequest("application/octet-stream", GenerateRandomReader(4097))
+			err := api.ScanRaw(c)
+			It("Should fail before reading the body", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusBadRequest))
+				Expect(rec.Body.String()).To(ContainSubstring(apipkg.ErrCodeSizeLimitExceeded))
+			})
+		})
+
+		Describe("With unknown length exceeding the limit", func() {
+			c, rec := newRequest("application/octet-stream", io.MultiReader(GenerateRandomReader(4097)))
+			c.Request().ContentLength = -1
+			err := api.ScanRaw(c)
+			It("Should fail while reading the body", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusBadRequest))
+				Expect(rec.Body.String()).To(ContainSubstring(apipkg.ErrCodeSizeLimitExceeded))
+			})
+		})
+
+		Describe("With wrong content-type", func() {
+			c, rec := newRequest("text/plain", GenerateRandomReader(1024))
+			err := api.ScanRaw(c)
+			It("Should fail", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusBadRequest))
+				Expect(rec.Body.String()).To(ContainSubstring("request Content-Type isn't application/octet-stream"))
+			})
+		})
+	})
+
+	Describe("Scan URL", func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/small.bin", func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, GenerateRandomReader(1024))
+		})
+		mux.HandleFunc("/large.bin", func(w http.ResponseWriter, r *http.Request) {
+			// no Content-Length, the size limit must be enforced while downloading
+			w.(http.Flusher).Flush()
+			io.Copy(w, GenerateRandomReader(8192))
+		})
+		server := httptest.NewServer(mux)
+
+		newRequest := func(urls ...string) (echo.Context, *httptest.ResponseRecorder) {
+			body, _ := json.Marshal(apipkg.ScanURLRequest{URLs: urls})
+			req := httptest.NewRequest(http.MethodPost, "/scan/url", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			return NewEchoContext(req)
+		}
+
+		Describe("With internal address", func() {
+			c, rec := newRequest(server.URL + "/small.bin")
+			err := api.ScanURL(c)
+			It("Should be forbidden", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusForbidden))
+				Expect(rec.Body.String()).To(ContainSubstring(apipkg.ErrCodeURLForbidden))
+			})
+		})
+
+		Describe("With allowed address", func() {
+			mock.Expect(INSTREAM, 1, RETURN_OK)
+			api.Fetchers = fetch.NewRemoteRegistry(&fetch.Guard{AllowCIDRs: loopback}, time.Second)
+			c, rec := newRequest(server.URL+"/small.bin", server.URL+"/large.bin")
+			err := api.ScanURL(c)
+			It("Should scan each url and abort large downloads", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusMultiStatus))
+
+				resp := apipkg.Response{}
+				Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+				Expect(resp.Results).To(HaveLen(2))
+				Expect(resp.Results[0].ID).To(Equal(server.URL + "/small.bin"))
+				Expect(resp.Results[0].Filename).To(Equal("small.bin"))
+				Expect(resp.Results[0].Status).To(Equal("success"))
+				Expect(resp.Results[1].Error).To(Equal(apipkg.ErrCodeSizeLimitExceeded))
+			})
+		})
+	})
+
+	Describe("Scan Expand", func() {
+		newRequest := func(query string, body []byte) (echo.Context, *httptest.ResponseRecorder) {
+			req := httptest.NewRequest(http.MethodPost, "/scan/raw"+query, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("X-Filename", "files.zip")
+			return NewEchoContext(req)
+		}
+		data := NewZip(map[string][]byte{"inner.tar.gz": NewTarGz(map[string][]byte{"evil.exe": []byte("evil")})})
+
+		Describe("With nested archives", func() {
+			mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+			c, rec := newRequest("?expand=true", data)
+			err := api.ScanRaw(c)
+			It("Should report the path of the infected entry", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusOK))
+
+				resp := apipkg.Response{}
+				Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+				Expect(resp.Results).To(HaveLen(1))
+				Expect(resp.Results[0].Filename).To(Equal("files.zip"))
+				Expect(resp.Results[0].Path).To(Equal("inner.tar.gz/evil.exe"))
+				Expect(resp.Results[0].Status).To(Equal("virus"))
+			})
+		})
+
+		Describe("With exceeded limits", func() {
+			api.ArchiveLimits.MaxDepth = 1
+			c, rec := newRequest("?expand=true", data)
+			err := api.ScanRaw(c)
+			api.ArchiveLimits.MaxDepth = 5
+			It("Should fail", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusBadRequest))
+				Expect(rec.Body.String()).To(ContainSubstring(apipkg.ErrCodeArchiveLimit))
+			})
+		})
+	})
+
+	Describe("Scan Email", func() {
+		newRequest := func(message string) (echo.Context, *httptest.ResponseRecorder) {
+			req := httptest.NewRequest(http.MethodPost, "/scan/email", strings.NewReader(message))
+			req.Header.Set("Content-Type", "message/rfc822")
+			return NewEchoContext(req)
+		}
+
+		Describe("With attachments", func() {
+			mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+			c, rec := newRequest(multipartMessage)
+			err := api.ScanEmail(c)
+			It("Should scan each part", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusOK))
+
+				resp := apipkg.Response{}
+				Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+				Expect(resp.Results).To(HaveLen(3))
+				Expect(resp.Results[0].ID).To(Equal("1"))
+				Expect(resp.Results[0].ContentType).To(Equal("text/plain"))
+				Expect(resp.Results[1].ID).To(Equal("2"))
+				Expect(resp.Results[1].Filename).To(Equal("résumé.bin"))
+				Expect(resp.Results[1].ContentType).To(Equal("application/octet-stream"))
+				Expect(resp.Results[1].Size).To(Equal(int64(len("hello world"))))
+				Expect(resp.Results[2].ID).To(Equal("3.1"))
+				Expect(resp.Results[2].Filename).To(Equal("nested.txt"))
+				Expect(*resp.Summary).To(Equal(apipkg.Summary{Total: 3, Infected: 3}))
+			})
+		})
+
+		Describe("With broken multipart body", func() {
+			mock.Expect(INSTREAM, 1, RETURN_OK)
+			c, rec := newRequest(strings.TrimSuffix(multipartMessage, "--outer--\r\n"))
+			err := api.ScanEmail(c)
+			It("Should report the parts and the error", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusMultiStatus))
+
+				resp := apipkg.Response{}
+				Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+				Expect(resp.Results).To(HaveLen(4))
+				Expect(resp.Results[3].Error).To(Equal(apipkg.ErrCodeInvalidRequest))
+			})
+		})
+
+		Describe("With wrong content-type", func() {
+			c, rec := NewEchoContext(httptest.NewRequest(http.MethodPost, "/scan/email", strings.NewReader(multipartMessage)))
+			err := api.ScanEmail(c)
+			It("Should fail", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusBadRequest))
+			})
+		})
+	})
+
+	Describe("Scan Batch Policy", func() {
+		newRequest := func() (echo.Context, *httptest.ResponseRecorder) {
+			req, err := NewMultipartFilesRequest(http.MethodPost, "/scan", "files",
+				[]string{"large.bin", "small.bin"},
+				[]io.Reader{GenerateRandomReader(4097), GenerateRandomReader(1024)},
+			)
+			if err != nil {
+				Fail(err.Error())
+			}
+			return NewEchoContext(req)
+		}
+
+		Describe("Continue", func() {
+			mock.Expect(INSTREAM, 1, RETURN_OK)
+			api.BatchPolicy = apipkg.Continue
+			c, rec := newRequest()
+			err := api.Scan(c)
+			It("Should scan the remaining files", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusMultiStatus))
+
+				resp := apipkg.Response{}
+				Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+				Expect(resp.Results).To(HaveLen(2))
+				Expect(resp.Results[0].Status).To(Equal("failed"))
+				Expect(resp.Results[0].Code).To(Equal(http.StatusBadRequest))
+				Expect(resp.Results[0].Error).To(Equal(apipkg.ErrCodeSizeLimitExceeded))
+				Expect(resp.Results[1].Status).To(Equal("success"))
+				Expect(resp.Results[1].Code).To(Equal(http.StatusOK))
+				Expect(*resp.Summary).To(Equal(apipkg.Summary{Total: 2, Clean: 1, Failed: 1}))
+			})
+		})
+
+		Describe("Fail-fast", func() {
+			api.BatchPolicy = apipkg.FailFast
+			c, rec := newRequest()
+			err := api.Scan(c)
+			api.BatchPolicy = apipkg.Continue
+			It("Should stop at the first failed file", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusBadRequest))
+
+				resp := apipkg.Response{}
+				Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+				Expect(resp.Results).To(HaveLen(1))
+				Expect(*resp.Summary).To(Equal(apipkg.Summary{Total: 1, Failed: 1}))
+			})
+		})
+	})
+
+	Describe("Jobs", func() {
+		getJob := func(id string) (apipkg.Job, *httptest.ResponseRecorder) {
+			c, rec := NewEchoContext(httptest.NewRequest(http.MethodGet, "/jobs/"+id, nil))
+			c.SetParamNames("id")
+			c.SetParamValues(id)
+			api.GetJob(c)
+			job := apipkg.Job{}
+			json.Unmarshal(rec.Body.Bytes(), &job)
+			return job, rec
+		}
+		waitForState := func(id string, state apipkg.JobState) apipkg.Job {
+			deadline := time.Now().Add(5 * time.Second)
+			job, _ := getJob(id)
+			for job.State != state && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+				job, _ = getJob(id)
+			}
+			return job
+		}
+
+		Describe("Submit", func() {
+			mock.Expect(INSTREAM, 1, RETURN_OK)
+			req, err := NewMultipartFilesRequest(http.MethodPost, "/jobs", "files",
+				[]string{"first.bin", "second.bin"},
+				[]io.Reader{GenerateRandomReader(1024), GenerateRandomReader(1024)},
+			)
+			if err != nil {
+				Fail(err.Error())
+			}
+			c, rec := NewEchoContext(req)
+			err = api.SubmitJob(c)
+			submitted := apipkg.Job{}
+			json.Unmarshal(rec.Body.Bytes(), &submitted)
+			job := waitForState(submitted.ID, apipkg.JobDone)
+
+			It("Should accept the job and scan the files asynchronously", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusAccepted))
+				Expect(rec.Header().Get("Location")).To(Equal("/jobs/" + submitted.ID))
+				Expect(submitted.State).To(Equal(apipkg.JobQueued))
+
+				Expect(job.State).To(Equal(apipkg.JobDone))
+				Expect(job.Code).To(Equal(http.StatusOK))
+				Expect(job.Finished).NotTo(BeNil())
+				Expect(job.Results).To(HaveLen(2))
+				Expect(job.Results[0].Filename).To(Equal("first.bin"))
+				Expect(job.Results[1].Status).To(Equal("success"))
+				Expect(*job.Summary).To(Equal(apipkg.Summary{Total: 2, Clean: 2}))
+			})
+		})
+
+		Describe("Cancel", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			}))
+			api.Fetchers = fetch.NewRemoteRegistry(&fetch.Guard{AllowCIDRs: loopback}, 5*time.Second)
+			body, _ := json.Marshal(apipkg.ScanURLRequest{URLs: []string{server.URL + "/slow.bin"}})
+			req := httptest.NewRequest(http.MethodPost, "/jobs", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			c, rec := NewEchoContext(req)
+			api.SubmitJob(c)
+			submitted := apipkg.Job{}
+			json.Unmarshal(rec.Body.Bytes(), &submitted)
+			running := waitForState(submitted.ID, apipkg.JobRunning)
+
+			c, rec = NewEchoContext(httptest.NewRequest(http.MethodDelete, "/jobs/"+submitted.ID, nil))
+			c.SetParamNames("id")
+			c.SetParamValues(submitted.ID)
+			err := api.CancelJob(c)
+			job := waitForState(submitted.ID, apipkg.JobCancelled)
+
+			It("Should cancel the running scan", func() {
+				Expect(running.State).To(Equal(apipkg.JobRunning))
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusOK))
+				Expect(job.State).To(Equal(apipkg.JobCancelled))
+				Expect(job.Results).To(HaveLen(1))
+				Expect(job.Results[0].Status).To(Equal("failed"))
+			})
+		})
+
+		Describe("Timeout", func() {
+			It("Should mark jobs which exceed the timeout", func() {
+				mock.Expect(INSTREAM, 1, RETURN_OK)
+				timeout := api.JobTimeout
+				api.JobTimeout = 500 * time.Millisecond
+				defer func() { api.JobTimeout = timeout }()
+
+				req := httptest.NewRequest(http.MethodPost, "/jobs", GenerateRandomReader(1024))
+				req.Header.Set("Content-Type", "application/octet-stream")
+				c, rec := NewEchoContext(req)
+				Expect(api.SubmitJob(c)).To(BeNil())
+				submitted := apipkg.Job{}
+				json.Unmarshal(rec.Body.Bytes(), &submitted)
+
+				job := waitForState(submitted.ID, apipkg.JobTimedOut)
+				Expect(job.State).To(Equal(apipkg.JobTimedOut))
+				Expect(job.Results).To(HaveLen(1))
+				Expect(job.Results[0].Status).To(Equal("failed"))
+			})
+		})
+
+		Describe("Shutdown", func() {
+			It("Should remove the files of queued jobs", func() {
+				spooled := func() int {
+					files, _ := filepath.Glob(filepath.Join(os.TempDir(), "clamav-facade-job-*"))
+					return len(files)
+				}
+				before := spooled()
+
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					<-r.Context().Done()
+				}))
+				defer server.Close()
+
+				stop := make(chan struct{})
+				stopping := apipkg.NewAPI("", "localhost:32123", client, stop, log.New("api_logger"), nil)
+				stopping.JobWorkers = 1
+				stopping.Fetchers = fetch.NewRemoteRegistry(&fetch.Guard{AllowCIDRs: loopback}, 5*time.Second)
+
+				// the only worker is blocked by the download, so that the second job stays queued
+				body, _ := json.Marshal(apipkg.ScanURLRequest{URLs: []string{server.URL + "/slow.bin"}})
+				req := httptest.NewRequest(http.MethodPost, "/jobs", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				c, rec := NewEchoContext(req)
+				Expect(stopping.SubmitJob(c)).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusAccepted))
+
+				req, err := NewMultipartFilesRequest(http.MethodPost, "/jobs", "files",
+					[]string{"first.bin", "second.bin"},
+					[]io.Reader{GenerateRandomReader(1024), GenerateRandomReader(1024)},
+				)
+				Expect(err).To(BeNil())
+				c, rec = NewEchoContext(req)
+				Expect(stopping.SubmitJob(c)).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusAccepted))
+				Expect(spooled()).To(Equal(before + 2))
+
+				close(stop)
+				Eventually(spooled).Should(Equal(before))
+			})
+		})
+
+		Describe("Unknown", func() {
+			_, rec := getJob("unknown")
+			It("Should not be found", func() {
+				Expect(rec.Code).To(Equal(http.StatusNotFound))
+				Expect(rec.Body.String()).To(ContainSubstring(apipkg.ErrCodeNotFound))
+			})
+		})
+	})
+
+	Describe("Webhooks", func() {
+		type delivery struct {
+			path, event string
+			body        []byte
+		}
+		deliveries := make(chan delivery, 2)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			deliveries <- delivery{r.URL.Path, r.Header.Get(webhook.EventHeader), body}
+		}))
+		newRequest := func(callback string) (echo.Context, *httptest.ResponseRecorder) {
+			req := httptest.NewRequest(http.MethodPost, "/scan/raw?callback_url="+url.QueryEscape(callback), GenerateRandomReader(1024))
+			req.Header.Set("Content-Type", "application/octet-stream")
+			return NewEchoContext(req)
+		}
+
+		Describe("With virus found", func() {
+			mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+			api.Webhooks = webhook.NewSender(nil, []byte("secret"))
+			api.InfectionWebhook = server.URL + "/infected"
+			c, rec := newRequest(server.URL + "/callback")
+			err := api.ScanRaw(c)
+			api.InfectionWebhook = ""
+
+			received := map[string]delivery{}
+			for i := 0; i < 2; i++ {
+				select {
+				case d := <-deliveries:
+					received[d.path] = d
+				case <-time.After(5 * time.Second):
+				}
+			}
+
+			It("Should deliver the response to the callback and the infection webhook", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusOK))
+				Expect(received).To(HaveKey("/callback"))
+				Expect(received).To(HaveKey("/infected"))
+				Expect(received["/callback"].event).To(Equal(apipkg.EventScanCompleted))
+				Expect(received["/infected"].event).To(Equal(apipkg.EventScanInfected))
+				Expect(received["/callback"].body).To(MatchJSON(rec.Body.Bytes()))
+			})
+		})
+
+		Describe("With operator webhook", func() {
+			It("Should not restrict the infection webhook like callbacks", func() {
+				webhooks := api.Webhooks
+				defer func() {
+					api.Webhooks, api.InfectionSender, api.InfectionWebhook = webhooks, nil, ""
+				}()
+				api.Webhooks = webhook.NewSender((&fetch.Guard{}).Client(time.Second), nil)
+				api.InfectionSender = webhook.NewSender(&http.Client{Timeout: time.Second}, nil)
+				api.InfectionWebhook = server.URL + "/infected"
+
+				mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+				c, rec := newRequest(server.URL + "/callback")
+				Expect(api.ScanRaw(c)).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusOK))
+
+				var d delivery
+				Eventually(deliveries, 5*time.Second).Should(Receive(&d))
+				Expect(d.path).To(Equal("/infected"))
+				Consistently(deliveries, time.Second).ShouldNot(Receive())
+			})
+		})
+
+		Describe("With invalid callback", func() {
+			c, rec := newRequest("ftp://example.com/callback")
+			err := api.ScanRaw(c)
+			It("Should reject the request", func() {
+				Expect(err).To(BeNil())
+				Expect(rec.Code).To(Equal(http.StatusBadRequest))
+				Expect(rec.Body.String()).To(ContainSubstring("invalid callback_url"))
 			})
 		})
 	})
@@ -156,6 +780,65 @@ var _ = Describe("API", func() {
 		It("Should succeed", func() {
 			Expect(err).To(BeNil())
 			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(ContainSubstring("\"threads\":{\"live\":1,\"idle\":0,\"max\":10,\"idle_timeout\":30}"))
+			Expect(rec.Body.String()).To(ContainSubstring("\"queue\":2"))
+		})
+	})
+
+	Describe("Version Success", func() {
+		c, rec := NewEchoContext(httptest.NewRequest(http.MethodGet, "/version", nil))
+		err := api.Version(c)
+		It("Should succeed", func() {
+			Expect(err).To(BeNil())
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(ContainSubstring("\"engine\":\"1.0.1\""))
+			Expect(rec.Body.String()).To(ContainSubstring("\"database_time\":\"2023-02-28T08:24:21Z\""))
+		})
+	})
+
+	Describe("Live", func() {
+		c, rec := NewEchoContext(httptest.NewRequest(http.MethodGet, "/livez", nil))
+		err := api.Live(c)
+		It("Should succeed", func() {
+			Expect(err).To(BeNil())
+			Expect(rec.Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("Ready Success", func() {
+		It("Should succeed if clamav answers", func() {
+			mock.Expect(PING, 1, RETURN_OK)
+			mock.Expect(STATS, 1, RETURN_OK)
+			api.MaxDatabaseAge = 100 * 365 * 24 * time.Hour
+			api.MaxQueueLength = 2
+			defer func() {
+				api.MaxDatabaseAge = 0
+				api.MaxQueueLength = 0
+			}()
+
+			c, rec := NewEchoContext(httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			Expect(api.Ready(c)).To(BeNil())
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(ContainSubstring("{\"id\":\"clamav\",\"status\":\"success\",\"details\":\"clamav is ready\"}"))
+			Expect(rec.Body.String()).To(ContainSubstring("{\"id\":\"database\",\"status\":\"success\""))
+			Expect(rec.Body.String()).To(ContainSubstring("{\"id\":\"queue\",\"status\":\"success\",\"details\":\"queue length is 2\"}"))
+		})
+	})
+
+	Describe("Ready Fails", func() {
+		mock.Expect(PING, 1, RETURN_OK)
+		api.MaxDatabaseAge = 72 * time.Hour
+		api.MaxQueueLength = 1
+		c, rec := NewEchoContext(httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		err := api.Ready(c)
+		api.MaxDatabaseAge = 0
+		api.MaxQueueLength = 0
+		It("Should report each failed check", func() {
+			Expect(err).To(BeNil())
+			Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rec.Body.String()).To(ContainSubstring("{\"id\":\"clamav\",\"status\":\"success\""))
+			Expect(rec.Body.String()).To(ContainSubstring("{\"id\":\"database\",\"status\":\"failed\",\"details\":\"signature database 26820 is outdated"))
+			Expect(rec.Body.String()).To(ContainSubstring("{\"id\":\"queue\",\"status\":\"failed\",\"details\":\"queue length 2 exceeds 1\"}"))
 		})
 	})
 
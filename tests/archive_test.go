@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/ron96G/clamav-facade/archive"
+)
+
+// NewZip returns a zip archive of the files
+func NewZip(files map[string][]byte) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		w, _ := zw.Create(name)
+		w.Write(content)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+// NewTarGz returns a gzip compressed tar archive of the files
+func NewTarGz(files map[string][]byte) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write(content)
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+// walkArchive returns the contents of the entries by their path
+func walkArchive(data []byte, limits archive.Limits) (map[string]string, error) {
+	entries := map[string]string{}
+	err := archive.Walk(bytes.NewReader(data), limits, func(entry *archive.Entry) error {
+		content, err := io.ReadAll(entry.Body)
+		entries[entry.Path] = string(content)
+		return err
+	})
+	return entries, err
+}
+
+var _ = Describe("Archive", func() {
+	It("Should expand nested archives", func() {
+		inner := NewTarGz(map[string][]byte{"lib/evil.exe": []byte("evil"), "readme.txt": []byte("readme")})
+		data := NewZip(map[string][]byte{"inner.tar.gz": inner, "./dir/../top.txt": []byte("top")})
+
+		entries, err := walkArchive(data, archive.DefaultLimits)
+		Expect(err).To(BeNil())
+		Expect(entries).To(Equal(map[string]string{
+			"inner.tar.gz/lib/evil.exe": "evil",
+			"inner.tar.gz/readme.txt":   "readme",
+			"top.txt":                   "top",
+		}))
+	})
+
+	It("Should pass through files which are not archives", func() {
+		entries, err := walkArchive([]byte("plain"), archive.DefaultLimits)
+		Expect(err).To(BeNil())
+		Expect(entries).To(Equal(map[string]string{"": "plain"}))
+	})
+
+	It("Should limit the nesting", func() {
+		data := NewZip(map[string][]byte{"a.zip": NewZip(map[string][]byte{"b.zip": NewZip(map[string][]byte{"c.txt": []byte("c")})})})
+		_, err := walkArchive(data, archive.Limits{MaxDepth: 2})
+		Expect(err).To(MatchError(archive.ErrLimitExceeded))
+		Expect(err.Error()).To(ContainSubstring("a.zip/b.zip"))
+
+		_, err = walkArchive(data, archive.Limits{MaxDepth: 3})
+		Expect(err).To(BeNil())
+	})
+
+	It("Should limit the number of entries", func() {
+		data := NewZip(map[string][]byte{"a": nil, "b": nil, "c": nil})
+		_, err := walkArchive(data, archive.Limits{MaxEntries: 2})
+		Expect(err).To(MatchError(archive.ErrLimitExceeded))
+	})
+
+	It("Should limit the compression ratio", func() {
+		data := NewTarGz(map[string][]byte{"zeros": make([]byte, 8<<20)})
+		_, err := walkArchive(data, archive.Limits{MaxRatio: 100})
+		Expect(err).To(MatchError(archive.ErrLimitExceeded))
+		Expect(err.Error()).To(ContainSubstring("compression ratio"))
+
+		zipped := NewZip(map[string][]byte{"zeros": make([]byte, 8<<20)})
+		_, err = walkArchive(zipped, archive.Limits{MaxRatio: 100})
+		Expect(err).To(MatchError(archive.ErrLimitExceeded))
+	})
+
+	It("Should limit the uncompressed size", func() {
+		data := NewTarGz(map[string][]byte{"a": make([]byte, 1024), "b": make([]byte, 1024)})
+		_, err := walkArchive(data, archive.Limits{MaxSize: 1500})
+		Expect(err).To(MatchError(archive.ErrLimitExceeded))
+	})
+
+	It("Should limit the size of all buffered zip archives", func() {
+		random, _ := io.ReadAll(GenerateRandomReader(600))
+		data := NewZip(map[string][]byte{"a.zip": NewZip(map[string][]byte{"b.bin": random})})
+		Expect(len(data)).To(BeNumerically("<", 1500))
+
+		_, err := walkArchive(data, archive.Limits{MaxSize: 1500})
+		Expect(err).To(MatchError(archive.ErrLimitExceeded))
+		Expect(err.Error()).To(ContainSubstring("a.zip"))
+
+		_, err = walkArchive(data, archive.Limits{MaxSize: 3000})
+		Expect(err).To(BeNil())
+	})
+})
@@ -0,0 +1,522 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing/iotest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/ron96G/clamav-facade/api"
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/go-common-utils/log"
+)
+
+var _ = Describe("Client", func() {
+	defer GinkgoRecover()
+
+	Describe("Parse address", func() {
+		It("Should parse a unix socket address", func() {
+			network, address, err := clamav.ParseAddress("unix:///run/clamav/clamd.ctl")
+			Expect(err).To(BeNil())
+			Expect(network).To(Equal("unix"))
+			Expect(address).To(Equal("/run/clamav/clamd.ctl"))
+		})
+
+		It("Should parse a tcp address", func() {
+			network, address, err := clamav.ParseAddress("tcp://localhost:3310")
+			Expect(err).To(BeNil())
+			Expect(network).To(Equal("tcp"))
+			Expect(address).To(Equal("localhost:3310"))
+		})
+
+		It("Should default to tcp", func() {
+			network, address, err := clamav.ParseAddress("localhost:3310")
+			Expect(err).To(BeNil())
+			Expect(network).To(Equal("tcp"))
+			Expect(address).To(Equal("localhost:3310"))
+		})
+
+		It("Should fail for unsupported schemes", func() {
+			_, _, err := clamav.ParseAddress("udp://localhost:3310")
+			Expect(err).NotTo(BeNil())
+		})
+	})
+
+	Describe("Unix socket transport", func() {
+		var dir string
+		var mock *MockServer
+		var client *clamav.ClamavClient
+
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "clamd")
+			Expect(err).To(BeNil())
+			socket := filepath.Join(dir, "clamd.ctl")
+			mock = NewUnixMockServer(socket)
+			Expect(mock.Listen()).To(BeNil())
+			go mock.Run()
+
+			client, err = clamav.NewClamavClientFromAddress("unix://"+socket, time.Second*10)
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			mock.Shutdown()
+			os.RemoveAll(dir)
+		})
+
+		It("Should ping clamav", func() {
+			mock.Expect(PING, 1, RETURN_OK)
+			Expect(client.Ping(context.Background())).To(BeNil())
+		})
+
+		It("Should scan a file", func() {
+			mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+			res, err := client.Scan(context.Background(), GenerateRandomReader(4096))
+			Expect(err).To(BeNil())
+			Expect(res.Infected()).To(BeTrue())
+			Expect(res.Signatures).To(ContainElement(VIRUS_SIGNATURE))
+			Expect(res.Size).To(BeEquivalentTo(4096))
+		})
+
+		It("Should return the version of the scan", func() {
+			mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+			mock.Expect(VERSION, 1, RETURN_OK)
+			client.ScanVersion = true
+			connections := mock.Connections()
+
+			res, err := client.Scan(context.Background(), GenerateRandomReader(4096))
+			Expect(err).To(BeNil())
+			Expect(res.Signatures).To(ContainElement(VIRUS_SIGNATURE))
+			Expect(res.Version.Database).To(Equal(26820))
+			Expect(mock.Connections() - connections).To(Equal(1))
+		})
+
+		It("Should return the verdict if the version could not be read", func() {
+			mock.Expect(INSTREAM, 1, RETURN_OK)
+			mock.Expect(VERSION, 1, RETURN_ERROR)
+			client.ScanVersion = true
+
+			res, err := client.Scan(context.Background(), GenerateRandomReader(4096))
+			Expect(err).To(BeNil())
+			Expect(res.Clean()).To(BeTrue())
+			Expect(res.Version).To(BeNil())
+		})
+	})
+
+	Describe("Session pool", func() {
+		mock := NewMockServer("localhost", 33101)
+		if err := mock.Listen(); err != nil {
+			panic(err)
+		}
+		go mock.Run()
+
+		var client *clamav.ClamavClient
+		BeforeEach(func() {
+			client, _ = clamav.NewClamavClient("localhost", 33101, time.Second*10)
+			client.EnablePool(clamav.PoolOptions{MaxIdle: 2})
+		})
+
+		AfterEach(func() {
+			client.Close()
+		})
+
+		It("Should reuse the session", func() {
+			mock.Expect(PING, 1, RETURN_OK)
+			mock.Expect(VERSION, 1, RETURN_OK)
+			mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+			connections := mock.Connections()
+
+			Expect(client.Ping(context.Background())).To(BeNil())
+			version, err := client.Version(context.Background())
+			Expect(err).To(BeNil())
+			Expect(version.Raw).To(Equal(MOCK_VERSION))
+			res, err := client.Scan(context.Background(), GenerateRandomReader(4096))
+			Expect(err).To(BeNil())
+			Expect(res.Signatures).To(ContainElement(VIRUS_SIGNATURE))
+			Expect(mock.Connections() - connections).To(Equal(1))
+		})
+
+		It("Should return the version of the scan within the session", func() {
+			mock.Expect(VERSION, 1, RETURN_OK)
+			mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+			client.ScanVersion = true
+			connections := mock.Connections()
+
+			for i := 0; i < 2; i++ {
+				res, err := client.Scan(context.Background(), GenerateRandomReader(4096))
+				Expect(err).To(BeNil())
+				Expect(res.Signatures).To(ContainElement(VIRUS_SIGNATURE))
+				Expect(res.Version.Raw).To(Equal(MOCK_VERSION))
+			}
+			Expect(mock.Connections() - connections).To(Equal(1))
+		})
+
+		It("Should demultiplex concurrent requests", func() {
+			mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+			connections := mock.Connections()
+
+			// the requests are started one after another to pipeline them on the same session
+			var wg sync.WaitGroup
+			results := make([]*clamav.ScanResult, 4)
+			errs := make([]error, 4)
+			for i := range results {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					results[i], errs[i] = client.Scan(context.Background(), NewSignatureReader(fmt.Sprintf("Mock.Signature-%d", i)))
+				}(i)
+				time.Sleep(50 * time.Millisecond)
+			}
+			wg.Wait()
+
+			for i := range results {
+				Expect(errs[i]).To(BeNil())
+				Expect(results[i].Signatures).To(Equal([]string{fmt.Sprintf("Mock.Signature-%d", i)}))
+			}
+			Expect(mock.Connections() - connections).To(Equal(1))
+		})
+
+		It("Should keep the session usable if a payload cannot be read", func() {
+			mock.Expect(INSTREAM, 1, RETURN_OK)
+			connections := mock.Connections()
+
+			var res *clamav.ScanResult
+			var err error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				res, err = client.Scan(context.Background(), GenerateRandomReader(1024))
+			}()
+			time.Sleep(50 * time.Millisecond)
+
+			broken := io.MultiReader(GenerateRandomReader(2048), iotest.ErrReader(errors.New("broken upload")))
+			_, brokenErr := client.Scan(context.Background(), broken)
+			var sourceErr *clamav.SourceError
+			Expect(errors.As(brokenErr, &sourceErr)).To(BeTrue())
+
+			<-done
+			Expect(err).To(BeNil())
+			Expect(res.Clean()).To(BeTrue())
+
+			res, err = client.Scan(context.Background(), GenerateRandomReader(1024))
+			Expect(err).To(BeNil())
+			Expect(res.Clean()).To(BeTrue())
+			Expect(mock.Connections() - connections).To(Equal(1))
+		})
+
+		It("Should keep the session if a request takes longer than the idle time", func() {
+			mock.Expect(INSTREAM, 1, RETURN_OK)
+			client.Close()
+			client.EnablePool(clamav.PoolOptions{MaxIdle: 2, MaxIdleTime: 500 * time.Millisecond})
+			connections := mock.Connections()
+
+			// writing the payload takes a second and clamd replies after another second
+			r, w := io.Pipe()
+			go func() {
+				for i := 0; i < 4; i++ {
+					time.Sleep(250 * time.Millisecond)
+					w.Write(make([]byte, 1024))
+				}
+				w.Close()
+			}()
+			res, err := client.Scan(context.Background(), r)
+			Expect(err).To(BeNil())
+			Expect(res.Clean()).To(BeTrue())
+
+			res, err = client.Scan(context.Background(), GenerateRandomReader(1024))
+			Expect(err).To(BeNil())
+			Expect(res.Clean()).To(BeTrue())
+			Expect(mock.Connections() - connections).To(Equal(1))
+		})
+	})
+
+	Describe("Backend group", func() {
+		first := NewMockServer("localhost", 33102)
+		if err := first.Listen(); err != nil {
+			panic(err)
+		}
+		go first.Run()
+
+		second := NewMockServer("localhost", 33109)
+		if err := second.Listen(); err != nil {
+			panic(err)
+		}
+		go second.Run()
+
+		var group *clamav.BackendGroup
+		newGroup := func(opts clamav.GroupOptions, ports ...uint) {
+			clients := []*clamav.ClamavClient{}
+			for _, port := range ports {
+				client, _ := clamav.NewClamavClient("localhost", port, time.Second*10)
+				clients = append(clients, client)
+			}
+			var err error
+			group, err = clamav.NewBackendGroup(clients, opts, log.New("group_logger"))
+			Expect(err).To(BeNil())
+		}
+
+		// scan returns the number of scans each backend received
+		scan := func(n int) (int, int) {
+			firstScans, secondScans := first.Received(INSTREAM), second.Received(INSTREAM)
+			for i := 0; i < n; i++ {
+				res, err := group.Scan(context.Background(), GenerateRandomReader(1024))
+				Expect(err).To(BeNil())
+				Expect(res.Clean()).To(BeTrue())
+			}
+			return first.Received(INSTREAM) - firstScans, second.Received(INSTREAM) - secondScans
+		}
+
+		// waitForHealthCheck waits until the next health check of both backends completed
+		waitForHealthCheck := func(command Command) {
+			firstChecks, secondChecks := first.Received(command), second.Received(command)
+			Eventually(func() bool {
+				return first.Received(command) > firstChecks && second.Received(command) > secondChecks
+			}, 10*time.Second, 50*time.Millisecond).Should(BeTrue())
+			// the reply is processed after it was counted by the mock
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		BeforeEach(func() {
+			first.Expect(INSTREAM, 1, RETURN_OK)
+			first.Expect(PING, 1, RETURN_OK)
+			first.Expect(STATS, 1, RETURN_OK)
+			second.Expect(INSTREAM, 1, RETURN_OK)
+			second.Expect(PING, 1, RETURN_OK)
+			second.Expect(STATS, 1, RETURN_OK)
+		})
+
+		AfterEach(func() {
+			group.Close()
+			first.SetStats(MOCK_STATS)
+		})
+
+		It("Should fail over to the reachable backend", func() {
+			// nothing is listening on the first backend
+			newGroup(clamav.GroupOptions{Strategy: clamav.LeastOutstanding, HealthInterval: time.Minute}, 33199, 33102)
+			firstScans, _ := scan(2)
+			Expect(firstScans).To(Equal(2))
+		})
+
+		It("Should distribute requests round-robin", func() {
+			newGroup(clamav.GroupOptions{Strategy: clamav.RoundRobin, HealthInterval: time.Minute}, 33102, 33109)
+			firstScans, secondScans := scan(4)
+			Expect(firstScans).To(Equal(2))
+			Expect(secondScans).To(Equal(2))
+		})
+
+		It("Should prefer the backend with the fewest outstanding requests", func() {
+			newGroup(clamav.GroupOptions{Strategy: clamav.LeastOutstanding, HealthInterval: time.Minute}, 33102, 33109)
+
+			// the stream is kept open until the other requests are done
+			connections := first.Connections() + second.Connections()
+			pr, pw := io.Pipe()
+			done := make(chan error)
+			go func() {
+				_, err := group.Scan(context.Background(), pr)
+				done <- err
+			}()
+			Eventually(func() int { return first.Connections() + second.Connections() }).Should(Equal(connections + 1))
+
+			firstScans, secondScans := scan(2)
+			pw.Close()
+			Expect(<-done).To(BeNil())
+			Expect([]int{firstScans, secondScans}).To(ConsistOf(0, 2))
+		})
+
+		It("Should prefer the backend with the shortest queue", func() {
+			first.SetStats(strings.Replace(MOCK_STATS, "QUEUE: 2 items", "QUEUE: 5 items", 1))
+			newGroup(clamav.GroupOptions{Strategy: clamav.LeastQueue, HealthInterval: 3 * time.Second}, 33102, 33109)
+			waitForHealthCheck(STATS)
+
+			firstScans, secondScans := scan(2)
+			Expect(firstScans).To(Equal(0))
+			Expect(secondScans).To(Equal(2))
+		})
+
+		It("Should eject unhealthy backends until they are ready again", func() {
+			first.Expect(PING, 1, RETURN_ERROR)
+			newGroup(clamav.GroupOptions{Strategy: clamav.RoundRobin, HealthInterval: 2 * time.Second}, 33102, 33109)
+			waitForHealthCheck(PING)
+
+			firstScans, secondScans := scan(2)
+			Expect(firstScans).To(Equal(0))
+			Expect(secondScans).To(Equal(2))
+
+			first.Expect(PING, 1, RETURN_OK)
+			waitForHealthCheck(PING)
+
+			firstScans, secondScans = scan(2)
+			Expect(firstScans).To(Equal(1))
+			Expect(secondScans).To(Equal(1))
+		})
+
+		It("Should check the file size against the smallest limit", func() {
+			large, _ := clamav.NewClamavClient("localhost", 33102, time.Second*10)
+			large.SetMaxSize(4096)
+			small, _ := clamav.NewClamavClient("localhost", 33109, time.Second*10)
+			small.SetMaxSize(1024)
+			var err error
+			group, err = clamav.NewBackendGroup([]*clamav.ClamavClient{large, small}, clamav.GroupOptions{HealthInterval: time.Minute}, log.New("group_logger"))
+			Expect(err).To(BeNil())
+
+			Expect(group.MaxFilesize()).To(Equal(1024))
+			Expect(group.CheckFilesize(1024)).To(BeTrue())
+			Expect(group.CheckFilesize(2048)).To(BeFalse())
+		})
+	})
+
+	Describe("Retry policy", func() {
+		mock := NewMockServer("localhost", 33110)
+		if err := mock.Listen(); err != nil {
+			panic(err)
+		}
+		go mock.Run()
+
+		var client *clamav.ClamavClient
+		BeforeEach(func() {
+			mock.Expect(PING, 1, RETURN_OK)
+			client, _ = clamav.NewClamavClient("localhost", 33110, time.Second*10)
+			client.SetRetryPolicy(clamav.RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, Multiplier: 2})
+		})
+
+		It("Should retry until clamd succeeds", func() {
+			mock.FailNext(PING, 2)
+			pings := mock.Received(PING)
+
+			Expect(client.Ping(context.Background())).To(BeNil())
+			Expect(mock.Received(PING) - pings).To(Equal(3))
+		})
+
+		It("Should give up after the maximum number of attempts", func() {
+			mock.FailNext(PING, 3)
+			pings := mock.Received(PING)
+
+			Expect(client.Ping(context.Background())).NotTo(BeNil())
+			Expect(mock.Received(PING) - pings).To(Equal(3))
+		})
+	})
+
+	Describe("Circuit breaker", func() {
+		var client *clamav.ClamavClient
+		BeforeEach(func() {
+			// nothing is listening on this port
+			client, _ = clamav.NewClamavClient("localhost", 33198, time.Second*10)
+			client.EnableCircuitBreaker(clamav.BreakerOptions{Threshold: 2, Cooldown: time.Minute})
+		})
+
+		It("Should open after consecutive failures", func() {
+			Expect(client.Ping(context.Background())).NotTo(MatchError(clamav.ErrCircuitOpen))
+			Expect(client.Ping(context.Background())).NotTo(MatchError(clamav.ErrCircuitOpen))
+			Expect(client.Breaker().State()).To(Equal(clamav.BreakerOpen))
+		})
+
+		It("Should fail fast with 503", func() {
+			client.Ping(context.Background())
+			client.Ping(context.Background())
+			api := api.NewAPI("", "localhost:32124", client, make(chan struct{}), log.New("api_logger"), nil)
+
+			c, rec := NewEchoContext(httptest.NewRequest(http.MethodGet, "/health", nil))
+			Expect(api.Ping(c)).To(BeNil())
+			Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rec.Header().Get("Retry-After")).NotTo(BeEmpty())
+			Expect(rec.Body.String()).To(ContainSubstring("circuit breaker is open"))
+		})
+
+		It("Should not close when the caller cancels the probe", func() {
+			mock := NewMockServer("localhost", 33111)
+			Expect(mock.Listen()).To(Succeed())
+			go mock.Run()
+			defer mock.Shutdown()
+			mock.Expect(PING, 1, RETURN_OK)
+
+			client, _ = clamav.NewClamavClient("localhost", 33111, time.Second*10)
+			client.EnablePool(clamav.PoolOptions{})
+			defer client.Close()
+			client.EnableCircuitBreaker(clamav.BreakerOptions{Threshold: 1, Cooldown: 100 * time.Millisecond})
+
+			mock.FailNext(PING, 1)
+			Expect(client.Ping(context.Background())).NotTo(BeNil())
+			Expect(client.Breaker().State()).To(Equal(clamav.BreakerOpen))
+			time.Sleep(200 * time.Millisecond)
+
+			// clamd replies after a second, the probe is cancelled before
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(200*time.Millisecond, cancel)
+			Expect(client.Ping(ctx)).To(MatchError(context.Canceled))
+			Expect(client.Breaker().State()).To(Equal(clamav.BreakerHalfOpen))
+
+			Expect(client.Ping(context.Background())).To(BeNil())
+			Expect(client.Breaker().State()).To(Equal(clamav.BreakerClosed))
+		})
+	})
+
+	Describe("Scan file", func() {
+		mock := NewMockServer("localhost", 33103)
+		if err := mock.Listen(); err != nil {
+			panic(err)
+		}
+		go mock.Run()
+
+		var client *clamav.ClamavClient
+		var dir, small, large string
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			mock.Expect(INSTREAM, 1, RETURN_OK)
+			client, _ = clamav.NewClamavClient("localhost", 33103, time.Second*10)
+			client.SetMaxSize(4096)
+
+			var err error
+			dir, err = os.MkdirTemp("", "scanfile")
+			Expect(err).To(BeNil())
+			small = filepath.Join(dir, "small.bin")
+			large = filepath.Join(dir, "large.bin")
+			os.WriteFile(small, make([]byte, 1024), 0o600)
+			os.WriteFile(large, make([]byte, 4097), 0o600)
+
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// no Content-Length, the size limit must be enforced while streaming
+				w.(http.Flusher).Flush()
+				w.Write(make([]byte, 8192))
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.RemoveAll(dir)
+		})
+
+		It("Should stream local files", func() {
+			res, err := client.ScanFile(context.Background(), small)
+			Expect(err).To(BeNil())
+			Expect(res.Size).To(BeEquivalentTo(1024))
+
+			res, err = client.ScanFile(context.Background(), "file://"+small)
+			Expect(err).To(BeNil())
+			Expect(res.Size).To(BeEquivalentTo(1024))
+		})
+
+		It("Should enforce the size limit", func() {
+			_, err := client.ScanFile(context.Background(), large)
+			Expect(err).To(MatchError(clamav.ErrFileTooLarge))
+			_, err = client.ScanFile(context.Background(), server.URL+"/large.bin")
+			Expect(err).To(MatchError(clamav.ErrFileTooLarge))
+		})
+
+		It("Should reject unsupported schemes", func() {
+			_, err := client.ScanFile(context.Background(), "ftp://localhost/small.bin")
+			Expect(err).To(MatchError(ContainSubstring("unsupported url scheme")))
+		})
+	})
+})
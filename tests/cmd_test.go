@@ -1 +1,73 @@
 package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/clamav-facade/cmd"
+	"github.com/ron96G/go-common-utils/log"
+)
+
+var _ = Describe("Path", func() {
+	defer GinkgoRecover()
+
+	mock := NewMockServer("localhost", 33108)
+	if err := mock.Listen(); err != nil {
+		panic(err)
+	}
+	go mock.Run()
+
+	client, _ := clamav.NewClamavClient("localhost", 33108, time.Second*10)
+	client.SetMaxSize(1 << 20)
+
+	// newTree returns a directory with a symbolic link to sub and a loop from sub/deep/up to sub
+	newTree := func() string {
+		root, err := os.MkdirTemp("", "scan-path-*")
+		Expect(err).To(BeNil())
+		for _, name := range []string{"a.exe", "b.txt", "sub/c.exe", "sub/deep/d.exe", "skip/e.exe"} {
+			os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755)
+			os.WriteFile(filepath.Join(root, name), []byte(name), 0644)
+		}
+		os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "link"))
+		os.Symlink("..", filepath.Join(root, "sub", "deep", "up"))
+		return root
+	}
+
+	scan := func(opts cmd.WalkOptions) *cmd.Summary {
+		root := newTree()
+		defer os.RemoveAll(root)
+		summary, err := cmd.ScanPath(context.Background(), client, root, opts, log.New("cmd_logger"))
+		Expect(err).To(BeNil())
+		return summary
+	}
+
+	It("Should scan all files concurrently", func() {
+		mock.Expect(INSTREAM, 1, RETURN_OK)
+		summary := scan(cmd.WalkOptions{Workers: 4})
+		Expect(*summary).To(Equal(cmd.Summary{Files: 5, Clean: 5, Bytes: summary.Bytes}))
+		Expect(summary.Bytes).To(BeNumerically(">", 0))
+	})
+
+	It("Should filter by globs and depth", func() {
+		mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+		summary := scan(cmd.WalkOptions{Include: []string{"*.exe"}, Exclude: []string{"skip"}, MaxDepth: 2, Workers: 2})
+		Expect(summary.Files).To(Equal(int64(2)))
+		Expect(summary.Infected).To(Equal(int64(2)))
+	})
+
+	It("Should follow symbolic links without loops", func() {
+		mock.Expect(INSTREAM, 1, RETURN_OK)
+		summary := scan(cmd.WalkOptions{Exclude: []string{"skip/*"}, FollowSymlinks: true, Workers: 4})
+		Expect(summary.Files).To(Equal(int64(6)))
+	})
+
+	It("Should fail for a missing root", func() {
+		_, err := cmd.ScanPath(context.Background(), client, filepath.Join(os.TempDir(), "missing-scan-path"), cmd.WalkOptions{}, log.New("cmd_logger"))
+		Expect(err).To(HaveOccurred())
+	})
+})
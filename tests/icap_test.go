@@ -0,0 +1,190 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/clamav-facade/icap"
+	"github.com/ron96G/go-common-utils/log"
+)
+
+type icapResponse struct {
+	status    string
+	header    textproto.MIMEHeader
+	resHeader string
+	body      string
+}
+
+// readICAPResponse reads a response of the server including the encapsulated header and body
+func readICAPResponse(r *bufio.Reader) (*icapResponse, error) {
+	tp := textproto.NewReader(r)
+	status, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	resp := &icapResponse{status: status, header: header}
+
+	offset := 0
+	for _, entry := range strings.Split(header.Get("Encapsulated"), ", ") {
+		name, rawOffset, _ := strings.Cut(entry, "=")
+		next, _ := strconv.Atoi(rawOffset)
+		if offset < next {
+			buf := make([]byte, next-offset)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, err
+			}
+			resp.resHeader += string(buf)
+		}
+		offset = next
+		if name == "res-body" || name == "req-body" {
+			for {
+				line, err := tp.ReadLine()
+				if err != nil {
+					return nil, err
+				}
+				size, _ := strconv.ParseInt(line, 16, 64)
+				if size == 0 {
+					tp.ReadLine()
+					break
+				}
+				buf := make([]byte, size+2)
+				if _, err := io.ReadFull(r, buf); err != nil {
+					return nil, err
+				}
+				resp.body += string(buf[:size])
+			}
+		}
+	}
+	return resp, nil
+}
+
+var _ = Describe("ICAP", func() {
+	defer GinkgoRecover()
+
+	mock := NewMockServer("localhost", 33104)
+	if err := mock.Listen(); err != nil {
+		panic(err)
+	}
+	go mock.Run()
+	mock.Expect(VERSION, 1, RETURN_OK)
+
+	client, _ := clamav.NewClamavClient("localhost", 33104, time.Second*10)
+	client.SetMaxSize(4096)
+	server := icap.NewServer("localhost:32125", client, make(chan struct{}), log.New("icap_logger"), nil)
+	server.PreviewSize = 4
+	if err := server.Listen(); err != nil {
+		panic(err)
+	}
+	go server.Run()
+
+	resHeader := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 11\r\n\r\n"
+	reqHeader := "GET http://example.com/file.txt HTTP/1.1\r\nHost: example.com\r\n\r\n"
+
+	send := func(request string) (*bufio.Reader, net.Conn) {
+		conn, err := net.Dial("tcp", "localhost:32125")
+		Expect(err).To(BeNil())
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, request)
+		Expect(err).To(BeNil())
+		return bufio.NewReader(conn), conn
+	}
+	respmod := func(header, body string) string {
+		return "RESPMOD icap://localhost/respmod ICAP/1.0\r\nHost: localhost\r\n" + header +
+			fmt.Sprintf("Encapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n", len(reqHeader), len(reqHeader)+len(resHeader)) +
+			reqHeader + resHeader + body
+	}
+
+	options := func() *icapResponse {
+		r, conn := send("OPTIONS icap://localhost/respmod ICAP/1.0\r\nHost: localhost\r\nEncapsulated: null-body=0\r\n\r\n")
+		defer conn.Close()
+		resp, err := readICAPResponse(r)
+		Expect(err).To(BeNil())
+		return resp
+	}
+
+	It("Should describe the service", func() {
+		resp := options()
+		Expect(resp.status).To(Equal("ICAP/1.0 200 OK"))
+		Expect(resp.header.Get("Methods")).To(Equal("RESPMOD"))
+		Expect(resp.header.Get("Allow")).To(Equal("204"))
+		Expect(resp.header.Get("Preview")).To(Equal("4"))
+	})
+
+	It("Should derive the ISTag from the signature database in the background", func() {
+		Eventually(func() string {
+			return options().header.Get("ISTag")
+		}, 5*time.Second, 100*time.Millisecond).Should(Equal(`"CF-26820"`))
+	})
+
+	It("Should reject encapsulated headers which exceed the limit", func() {
+		r, conn := send("RESPMOD icap://localhost/respmod ICAP/1.0\r\nHost: localhost\r\n" +
+			fmt.Sprintf("Encapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n", 1<<30, 1<<31) + reqHeader)
+		defer conn.Close()
+		resp, err := readICAPResponse(r)
+		Expect(err).To(BeNil())
+		Expect(resp.status).To(HavePrefix("ICAP/1.0 400"))
+		Expect(resp.header.Get("Connection")).To(Equal("close"))
+		Expect(resp.header.Get("ISTag")).To(HavePrefix(`"CF-`))
+	})
+
+	It("Should reject unknown services", func() {
+		r, conn := send("OPTIONS icap://localhost/unknown ICAP/1.0\r\nEncapsulated: null-body=0\r\n\r\n")
+		defer conn.Close()
+		resp, err := readICAPResponse(r)
+		Expect(err).To(BeNil())
+		Expect(resp.status).To(HavePrefix("ICAP/1.0 404"))
+	})
+
+	It("Should allow clean content after the preview with 204", func() {
+		mock.Expect(INSTREAM, 1, RETURN_OK)
+		r, conn := send(respmod("Allow: 204\r\nPreview: 4\r\n", "4\r\nhell\r\n0\r\n\r\n"))
+		defer conn.Close()
+
+		status, err := r.ReadString('\n')
+		Expect(err).To(BeNil())
+		Expect(status).To(Equal("ICAP/1.0 100 Continue\r\n"))
+		r.ReadString('\n')
+		io.WriteString(conn, "7\r\no world\r\n0\r\n\r\n")
+
+		resp, err := readICAPResponse(r)
+		Expect(err).To(BeNil())
+		Expect(resp.status).To(Equal("ICAP/1.0 204 No Content"))
+	})
+
+	It("Should return clean content if 204 is not allowed", func() {
+		mock.Expect(INSTREAM, 1, RETURN_OK)
+		r, conn := send(respmod("", "b\r\nhello world\r\n0\r\n\r\n"))
+		defer conn.Close()
+		resp, err := readICAPResponse(r)
+		Expect(err).To(BeNil())
+		Expect(resp.status).To(Equal("ICAP/1.0 200 OK"))
+		Expect(resp.resHeader).To(Equal(resHeader))
+		Expect(resp.body).To(Equal("hello world"))
+	})
+
+	It("Should replace infected content with the block page", func() {
+		mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+		r, conn := send(respmod("Allow: 204\r\n", "b\r\nhello world\r\n0\r\n\r\n"))
+		defer conn.Close()
+		resp, err := readICAPResponse(r)
+		Expect(err).To(BeNil())
+		Expect(resp.status).To(Equal("ICAP/1.0 200 OK"))
+		Expect(resp.header.Get("X-Infection-Found")).To(ContainSubstring("Threat=" + VIRUS_SIGNATURE))
+		Expect(resp.resHeader).To(HavePrefix("HTTP/1.1 403 Forbidden"))
+		Expect(resp.body).To(ContainSubstring("http://example.com/file.txt"))
+		Expect(resp.body).To(ContainSubstring(VIRUS_SIGNATURE))
+	})
+})
@@ -0,0 +1,244 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/clamav-facade/email"
+	"github.com/ron96G/clamav-facade/milter"
+	"github.com/ron96G/go-common-utils/log"
+)
+
+const multipartMessage = "From: sender@example.com\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Hello =3D world\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream; name=\"report.bin\"\r\n" +
+	"Content-Disposition: attachment; filename=\"=?UTF-8?Q?r=C3=A9sum=C3=A9.bin?=\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"aGVsbG8g\r\nd29ybGQ=\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: nested\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; name=\"nested.txt\"\r\n" +
+	"\r\n" +
+	"nested\r\n" +
+	"--inner--\r\n" +
+	"--outer--\r\n"
+
+// milterSession speaks the milter protocol of an MTA
+type milterSession struct {
+	conn net.Conn
+}
+
+func (m *milterSession) send(cmd byte, data ...string) {
+	payload := []byte{cmd}
+	for _, d := range data {
+		payload = append(payload, d...)
+	}
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(payload)))
+	m.conn.Write(append(size, payload...))
+}
+
+func (m *milterSession) read() (byte, string) {
+	size := make([]byte, 4)
+	_, err := io.ReadFull(m.conn, size)
+	Expect(err).To(BeNil())
+	buf := make([]byte, binary.BigEndian.Uint32(size))
+	_, err = io.ReadFull(m.conn, buf)
+	Expect(err).To(BeNil())
+	return buf[0], string(buf[1:])
+}
+
+// deliver sends the message and returns the replies to the end of body
+func (m *milterSession) deliver(message string) (replies []string) {
+	header, body, _ := strings.Cut(message, "\r\n\r\n")
+	m.send('M', "<sender@example.com>\000")
+	Expect(m.read()).To(Equal(byte('c')))
+	for _, line := range strings.Split(header, "\r\n") {
+		name, value, _ := strings.Cut(line, ":")
+		m.send('L', name, "\000", strings.TrimSpace(value), "\000")
+		Expect(m.read()).To(Equal(byte('c')))
+	}
+	m.send('N')
+	Expect(m.read()).To(Equal(byte('c')))
+	m.send('B', body)
+	Expect(m.read()).To(Equal(byte('c')))
+	m.send('E')
+	for {
+		cmd, data := m.read()
+		replies = append(replies, string(cmd)+data)
+		if cmd != 'h' && cmd != 'q' {
+			return replies
+		}
+	}
+}
+
+func newMilterSession(addr string) *milterSession {
+	return negotiateMilterSession(addr, 0x1ff)
+}
+
+// negotiateMilterSession connects to the milter and grants it the actions
+func negotiateMilterSession(addr string, actions uint32) *milterSession {
+	conn, err := net.Dial("tcp", addr)
+	Expect(err).To(BeNil())
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	m := &milterSession{conn: conn}
+
+	negotiation := make([]byte, 12)
+	binary.BigEndian.PutUint32(negotiation[0:4], 6)
+	binary.BigEndian.PutUint32(negotiation[4:8], actions)
+	binary.BigEndian.PutUint32(negotiation[8:12], 0x1fffff)
+	m.send('O', string(negotiation))
+	cmd, data := m.read()
+	Expect(cmd).To(Equal(byte('O')))
+	Expect(binary.BigEndian.Uint32([]byte(data[4:8]))).To(Equal(actions & 0x21))
+	return m
+}
+
+var _ = Describe("Email", func() {
+	It("Should walk every part of a message", func() {
+		var parts []email.Part
+		var bodies []string
+		err := email.Walk(strings.NewReader(multipartMessage), func(p *email.Part) error {
+			body, err := io.ReadAll(p.Body)
+			parts = append(parts, *p)
+			bodies = append(bodies, string(body))
+			return err
+		})
+		Expect(err).To(BeNil())
+		Expect(parts).To(HaveLen(3))
+		Expect(bodies).To(Equal([]string{"Hello = world", "hello world", "nested"}))
+
+		Expect(parts[0].Path).To(Equal("1"))
+		Expect(parts[0].IsAttachment()).To(BeFalse())
+		Expect(parts[1].Path).To(Equal("2"))
+		Expect(parts[1].Filename).To(Equal("résumé.bin"))
+		Expect(parts[1].ContentType).To(Equal("application/octet-stream"))
+		Expect(parts[1].IsAttachment()).To(BeTrue())
+		Expect(parts[2].Path).To(Equal("3.1"))
+		Expect(parts[2].Filename).To(Equal("nested.txt"))
+	})
+
+	It("Should treat a message without content type as text", func() {
+		var parts []*email.Part
+		err := email.Walk(strings.NewReader("Subject: hi\r\n\r\nhello"), func(p *email.Part) error {
+			parts = append(parts, p)
+			return nil
+		})
+		Expect(err).To(BeNil())
+		Expect(parts).To(HaveLen(1))
+		Expect(parts[0].ContentType).To(Equal("text/plain"))
+	})
+})
+
+var _ = Describe("Milter", func() {
+	defer GinkgoRecover()
+
+	mock := NewMockServer("localhost", 33106)
+	if err := mock.Listen(); err != nil {
+		panic(err)
+	}
+	go mock.Run()
+
+	client, _ := clamav.NewClamavClient("localhost", 33106, time.Second*10)
+	client.SetMaxSize(1 << 20)
+	server := milter.NewServer("localhost:32128", client, make(chan struct{}), log.New("milter_logger"))
+	server.Policy.Failed = milter.ActionAddHeader
+	if err := server.Listen(); err != nil {
+		panic(err)
+	}
+	go server.Run()
+
+	quarantineServer := milter.NewServer("localhost:32129", client, make(chan struct{}), log.New("milter_logger"))
+	quarantineServer.Policy.Infected = milter.ActionQuarantine
+	if err := quarantineServer.Listen(); err != nil {
+		panic(err)
+	}
+	go quarantineServer.Run()
+
+	It("Should accept clean messages and add the status header", func() {
+		mock.Expect(INSTREAM, 1, RETURN_OK)
+		m := newMilterSession("localhost:32128")
+		defer m.conn.Close()
+
+		replies := m.deliver(multipartMessage)
+		Expect(replies).To(Equal([]string{"hX-Virus-Status\000Clean\000", "a"}))
+	})
+
+	It("Should reject infected messages", func() {
+		mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+		m := newMilterSession("localhost:32128")
+		defer m.conn.Close()
+
+		replies := m.deliver("Subject: hi\r\n\r\nhello")
+		Expect(replies).To(HaveLen(1))
+		Expect(replies[0]).To(HavePrefix("y550 5.7.1 "))
+		Expect(replies[0]).To(ContainSubstring(VIRUS_SIGNATURE))
+	})
+
+	It("Should add the header to messages which could not be scanned", func() {
+		mock.Expect(INSTREAM, 1, RETURN_ERROR)
+		m := newMilterSession("localhost:32128")
+		defer m.conn.Close()
+
+		replies := m.deliver("Subject: hi\r\n\r\nhello")
+		Expect(replies).To(Equal([]string{"hX-Virus-Status\000Unscanned\000", "a"}))
+	})
+
+	It("Should skip the header if the MTA does not allow to add headers", func() {
+		mock.Expect(INSTREAM, 1, RETURN_ERROR)
+		m := negotiateMilterSession("localhost:32128", 0x1ff&^0x01)
+		defer m.conn.Close()
+
+		replies := m.deliver("Subject: hi\r\n\r\nhello")
+		Expect(replies).To(Equal([]string{"a"}))
+	})
+
+	It("Should reject infected messages if the MTA does not allow to quarantine them", func() {
+		mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+		m := newMilterSession("localhost:32129")
+		defer m.conn.Close()
+
+		replies := m.deliver("Subject: hi\r\n\r\nhello")
+		Expect(replies).To(HaveLen(2))
+		Expect(replies[0]).To(HavePrefix("q"))
+		Expect(replies[1]).To(Equal("a"))
+
+		m = negotiateMilterSession("localhost:32129", 0x1ff&^0x20)
+		defer m.conn.Close()
+
+		replies = m.deliver("Subject: hi\r\n\r\nhello")
+		Expect(replies).To(HaveLen(1))
+		Expect(replies[0]).To(HavePrefix("y550 5.7.1 "))
+	})
+
+	It("Should reuse the connection for the next message", func() {
+		mock.Expect(INSTREAM, 1, RETURN_OK)
+		m := newMilterSession("localhost:32128")
+		defer m.conn.Close()
+
+		for i := 0; i < 2; i++ {
+			replies := m.deliver("Subject: hi\r\n\r\n" + string(bytes.Repeat([]byte("a"), 100)))
+			Expect(replies[len(replies)-1]).To(Equal("a"))
+		}
+	})
+})
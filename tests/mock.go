@@ -2,20 +2,31 @@ package tests
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/ron96G/clamav-facade/clamav"
 )
 
 type MockServer struct {
-	host     string
-	port     int
-	listener net.Listener
-	once     sync.Once
-	expected map[Command]Expectation
+	network     string
+	address     string
+	listener    net.Listener
+	once        sync.Once
+	connections int32
+	streamed    int64
+	mu          sync.Mutex
+	expected    map[Command]Expectation
+	received    map[Command]int
+	failures    map[Command]int
+	stats       string
 }
 
 type Expectation struct {
@@ -28,6 +39,8 @@ type isExpectedFunc func(command Command) (bool, CommandType)
 type TcpClient struct {
 	conn       net.Conn
 	isExpected isExpectedFunc
+	stats      func() string
+	streamed   *int64
 }
 
 type CommandType string
@@ -37,26 +50,95 @@ const (
 	RETURN_FAIL  CommandType = "FAIL"
 	RETURN_VIRUS CommandType = "VIRUS"
 	RETURN_OK    CommandType = "OK"
+	RETURN_ERROR CommandType = "ERROR"
 
 	INSTREAM = "zINSTREAM"
 	PING     = "PING"
 	STATS    = "zSTATS"
 	RELOAD   = "RELOAD"
+	VERSION  = "VERSION"
+
+	IDSESSION = "zIDSESSION"
+	END       = "zEND"
+
+	MOCK_VERSION = "ClamAV 1.0.1/26820/Tue Feb 28 08:24:21 2023"
+	MOCK_STATS   = "POOLS: 1\n\nSTATE: VALID PRIMARY\nTHREADS: live 1  idle 0 max 10 idle-timeout 30\nQUEUE: 2 items\n\tSTATS 0.000064 \n\n" +
+		"MEMSTATS: heap N/A mmap N/A used N/A free N/A releasable N/A pools 1 pools_used 1280.741M pools_total 1280.788M\nEND"
+
+	VIRUS_SIGNATURE = "Win.Test.EICAR_HDB-1"
+	// SIGNATURE_PREFIX starts a stream whose remaining content is returned as the signature if a virus is expected
+	SIGNATURE_PREFIX = "MOCK-SIGNATURE:"
 )
 
 func NewMockServer(host string, port int) *MockServer {
 	return &MockServer{
-		host:     host,
-		port:     port,
+		network:  "tcp",
+		address:  fmt.Sprintf("%s:%d", host, port),
 		expected: make(map[Command]Expectation),
+		received: make(map[Command]int),
+		failures: make(map[Command]int),
+		stats:    MOCK_STATS,
 	}
 }
 
+// NewUnixMockServer returns a mock server which listens on the unix socket at path
+func NewUnixMockServer(path string) *MockServer {
+	return &MockServer{
+		network:  "unix",
+		address:  path,
+		expected: make(map[Command]Expectation),
+		received: make(map[Command]int),
+		failures: make(map[Command]int),
+		stats:    MOCK_STATS,
+	}
+}
+
+// Connections returns the number of accepted connections
+func (server *MockServer) Connections() int {
+	return int(atomic.LoadInt32(&server.connections))
+}
+
+// FailNext closes the connection without a reply for the next n commands of the given type
+func (server *MockServer) FailNext(command Command, n int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.failures[command] = n
+}
+
+// Streamed returns the number of payload bytes received by INSTREAM commands so far
+func (server *MockServer) Streamed() int64 {
+	return atomic.LoadInt64(&server.streamed)
+}
+
+// Received returns the number of received commands of the given type
+func (server *MockServer) Received(command Command) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.received[command]
+}
+
+// SetStats sets the reply to successful STATS commands
+func (server *MockServer) SetStats(stats string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.stats = stats
+}
+
+func (server *MockServer) getStats() string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.stats
+}
+
 func (server *MockServer) GetExpected() map[Command]Expectation {
+	server.mu.Lock()
+	defer server.mu.Unlock()
 	return server.expected
 }
 
 func (server *MockServer) Expect(command Command, times int, commandType CommandType) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
 	server.expected[command] = struct {
 		times       int
 		commandType CommandType
@@ -64,6 +146,13 @@ func (server *MockServer) Expect(command Command, times int, commandType Command
 }
 
 func (server *MockServer) isExpected(command Command) (bool, CommandType) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.received[command]++
+	if server.failures[command] > 0 {
+		server.failures[command]--
+		return true, RETURN_FAIL
+	}
 	if c, found := server.expected[command]; found {
 		if c.times > 0 {
 			c.times--
@@ -79,24 +168,37 @@ func (server *MockServer) Shutdown() {
 	}
 }
 
+// Listen opens the listener of the server. It should be called before Run
+// to make sure that the server is accepting connections once Run is started.
+func (server *MockServer) Listen() (err error) {
+	server.listener, err = net.Listen(server.network, server.address)
+	return err
+}
+
 func (server *MockServer) Run() {
-	var err error
-	server.listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", server.host, server.port))
-	if err != nil {
-		panic(err)
+	if server.listener == nil {
+		if err := server.Listen(); err != nil {
+			panic(err)
+		}
 	}
 	defer server.Shutdown()
 	for {
 		conn, err := server.listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			panic(err)
 		}
 
-		fmt.Printf("Connection accepted: %s\n", conn.RemoteAddr().String())
+		fmt.Printf("Connection accepted: %s\n", server.address)
+		atomic.AddInt32(&server.connections, 1)
 
 		client := &TcpClient{
 			conn:       conn,
 			isExpected: server.isExpected,
+			stats:      server.getStats,
+			streamed:   &server.streamed,
 		}
 		go client.handleRequest()
 	}
@@ -116,88 +218,160 @@ func (client *TcpClient) expectedOrDie(command Command) CommandType {
 	return commandType
 }
 
-func (client *TcpClient) handleRequest() {
-	reader := bufio.NewReader(client.conn)
-	writer := client.conn.(io.Writer)
-	defer client.conn.Close()
+// readStream consumes the chunks of an INSTREAM command until the terminating zero-length chunk
+func (client *TcpClient) readStream(reader io.Reader) ([]byte, error) {
+	return io.ReadAll(&countingReader{r: clamav.NewStreamReader(reader), n: client.streamed})
+}
 
-	command, err := reader.ReadString('\000')
-	if err != nil {
-		panic(err)
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// NewSignatureReader returns a stream for which the mock reports the signature if a virus is expected
+func NewSignatureReader(signature string) io.Reader {
+	return strings.NewReader(SIGNATURE_PREFIX + signature)
+}
+
+// commands maps the name of a command without its 'z' or 'n' prefix to the expected command
+var commands = map[string]Command{
+	"INSTREAM": INSTREAM,
+	"PING":     PING,
+	"STATS":    STATS,
+	"RELOAD":   RELOAD,
+	"VERSION":  VERSION,
+}
+
+func isInstream(command string) bool {
+	return commands[strings.TrimLeft(command, "zn")] == INSTREAM
+}
+
+// reply returns the response of the mock for the command. If ok is false,
+// the connection should be closed without a response.
+// The stream of an INSTREAM command must be consumed before and passed as stream.
+func (client *TcpClient) reply(command string, stream []byte) (resp string, ok bool) {
+	expected, found := commands[strings.TrimLeft(command, "zn")]
+	if !found {
+		panic("UNKNOWN COMMAND")
 	}
+	time.Sleep(1 * time.Second)
 
-	command = strings.Trim(command, "\000")
+	commandType := client.expectedOrDie(expected)
+	if commandType == RETURN_FAIL {
+		return "", false
+	}
 
-	var resp []byte
-	fmt.Printf("Received command: \"%s\"\n", command)
-	switch command {
+	switch expected {
 	case INSTREAM:
-		time.Sleep(1 * time.Second)
-
-		commandType := client.expectedOrDie(Command(command))
-		if commandType == RETURN_FAIL {
-			return // close connection
-		} else if commandType == RETURN_OK {
-			resp = []byte("Stream: OK\n")
-		} else {
-			resp = []byte("Stream: Virus\n")
+		if commandType == RETURN_OK {
+			return "stream: OK", true
+		} else if commandType == RETURN_ERROR {
+			return "INSTREAM size limit exceeded. ERROR", true
 		}
-		_, err := writer.Write(resp)
-		if err != nil {
-			panic(err)
+		if bytes.HasPrefix(stream, []byte(SIGNATURE_PREFIX)) {
+			return "stream: " + string(stream[len(SIGNATURE_PREFIX):]) + " FOUND", true
 		}
+		return "stream: " + VIRUS_SIGNATURE + " FOUND", true
 
-	case PING:
-		time.Sleep(1 * time.Second)
-
-		commandType := client.expectedOrDie(Command(command))
-		if commandType == RETURN_FAIL {
-			return // close connection
-		} else if commandType == RETURN_OK {
-			resp = []byte("PONG\n")
-		} else {
-			resp = []byte("FOOBAR\n")
-		}
-		_, err := writer.Write(resp)
-		if err != nil {
-			panic(err)
+	case VERSION:
+		if commandType == RETURN_OK {
+			return MOCK_VERSION, true
 		}
+		return "FOOBAR", true
 
 	case STATS:
-		time.Sleep(1 * time.Second)
-
-		commandType := client.expectedOrDie(Command(command))
-		if commandType == RETURN_FAIL {
-			return // close connection
-		} else if commandType == RETURN_OK {
-			resp = []byte("PONG\n")
-		} else {
-			resp = []byte("FOOBAR\n")
+		if commandType == RETURN_OK {
+			return client.stats(), true
 		}
-		_, err := writer.Write(resp)
-		if err != nil {
-			panic(err)
+		return "FOOBAR", true
+
+	default:
+		if commandType == RETURN_OK {
+			return "PONG", true
 		}
+		return "FOOBAR", true
+	}
+}
+
+func (client *TcpClient) handleRequest() {
+	reader := bufio.NewReader(client.conn)
+	writer := client.conn.(io.Writer)
+	defer client.conn.Close()
+
+	cmd, err := clamav.ReadCommand(reader)
+	if err != nil {
+		panic(err)
+	}
 
-	case RELOAD:
-		time.Sleep(1 * time.Second)
+	command := cmd.Name
+	fmt.Printf("Received command: \"%s\"\n", command)
+
+	if "z"+command == IDSESSION {
+		client.handleSession(reader)
+		return
+	}
 
-		commandType := client.expectedOrDie(Command(command))
-		if commandType == RETURN_FAIL {
-			return // close connection
-		} else if commandType == RETURN_OK {
-			resp = []byte("PONG\n")
-		} else {
-			resp = []byte("FOOBAR\n")
+	var stream []byte
+	if isInstream(command) {
+		if stream, err = client.readStream(reader); err != nil {
+			return // the client aborted the stream
 		}
-		_, err := writer.Write(resp)
+	}
+
+	resp, ok := client.reply(command, stream)
+	if !ok {
+		return // close connection
+	}
+	_, err = writer.Write([]byte(resp + "\n"))
+	if err != nil {
+		panic(err)
+	}
+	client.shutdownWrite()
+}
+
+// handleSession replies to all commands of an IDSESSION until it is ended.
+// Commands are processed concurrently, so replies may be sent out of order.
+func (client *TcpClient) handleSession(reader *bufio.Reader) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for id := 1; ; id++ {
+		cmd, err := clamav.ReadCommand(reader)
 		if err != nil {
-			panic(err)
+			return
+		}
+		command := cmd.Name
+		fmt.Printf("Received session command: \"%s\"\n", command)
+		if "z"+command == END {
+			return
 		}
 
-	default:
-		panic("UNKNOWN COMMAND")
+		// the stream must be consumed before the next command can be read
+		var stream []byte
+		if isInstream(command) {
+			if stream, err = client.readStream(reader); err != nil {
+				return
+			}
+		}
 
+		wg.Add(1)
+		go func(id int, command string, stream []byte) {
+			defer wg.Done()
+			resp, ok := client.reply(command, stream)
+			mu.Lock()
+			defer mu.Unlock()
+			if !ok {
+				client.conn.Close()
+				return
+			}
+			client.conn.Write([]byte(fmt.Sprintf("%d: %s\000", id, resp)))
+		}(id, command, stream)
 	}
-	client.shutdownWrite()
 }
@@ -0,0 +1,210 @@
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/clamav-facade/oci"
+)
+
+type tarFile struct {
+	name    string
+	content string
+	dir     bool
+}
+
+// NewTar returns a tar archive of the files in their order
+func NewTar(files ...tarFile) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}
+		if f.dir {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		tw.WriteHeader(hdr)
+		tw.Write([]byte(f.content))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func gzipped(data []byte) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	gw.Write(data)
+	gw.Close()
+	return buf.Bytes()
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// writeTar writes the files as a tar archive to a temporary file and returns its path
+func writeTar(files ...tarFile) string {
+	f, err := os.CreateTemp("", "image-*.tar")
+	Expect(err).To(BeNil())
+	defer f.Close()
+	f.Write(NewTar(files...))
+	return f.Name()
+}
+
+var _ = Describe("OCI", func() {
+	defer GinkgoRecover()
+
+	mock := NewMockServer("localhost", 33107)
+	if err := mock.Listen(); err != nil {
+		panic(err)
+	}
+	go mock.Run()
+
+	client, _ := clamav.NewClamavClient("localhost", 33107, time.Second*10)
+	client.SetMaxSize(1 << 20)
+
+	// the lower layer is compressed, the upper layer deletes and overwrites its files
+	lower := gzipped(NewTar(
+		tarFile{name: "etc/", dir: true},
+		tarFile{name: "etc/passwd", content: "root"},
+		tarFile{name: "app/old.bin", content: "old"},
+		tarFile{name: "app/deleted.bin", content: "deleted"},
+		tarFile{name: "data/x.txt", content: "x"},
+	))
+	upper := NewTar(
+		tarFile{name: "app/.wh.deleted.bin"},
+		tarFile{name: "app/old.bin", content: "new"},
+		tarFile{name: "data/.wh..wh..opq"},
+		tarFile{name: "data/y.txt", content: "y"},
+	)
+
+	It("Should scan the visible files of an OCI image layout", func() {
+		mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+		manifest, _ := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"layers": []map[string]string{
+				{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": digest(lower)},
+				{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": digest(upper)},
+			},
+		})
+		index, _ := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"manifests": []map[string]interface{}{{
+				"mediaType":   "application/vnd.oci.image.manifest.v1+json",
+				"digest":      digest(manifest),
+				"annotations": map[string]string{"org.opencontainers.image.ref.name": "app:1.0"},
+			}},
+		})
+		blob := func(data []byte) string { return "blobs/sha256/" + digest(data)[len("sha256:"):] }
+		filename := writeTar(
+			tarFile{name: "oci-layout", content: `{"imageLayoutVersion":"1.0.0"}`},
+			tarFile{name: "index.json", content: string(index)},
+			tarFile{name: blob(manifest), content: string(manifest)},
+			tarFile{name: blob(lower), content: string(lower)},
+			tarFile{name: blob(upper), content: string(upper)},
+		)
+		defer os.Remove(filename)
+
+		img, err := oci.Open(filename)
+		Expect(err).To(BeNil())
+		defer img.Close()
+		Expect(img.Tags).To(Equal([]string{"app:1.0"}))
+
+		report, err := img.Scan(context.Background(), client)
+		Expect(err).To(BeNil())
+		Expect(report.Layers).To(Equal(2))
+		Expect(report.Scanned).To(Equal(3))
+		Expect(report.Failed()).To(BeTrue())
+		Expect(report.Findings).To(ConsistOf(
+			oci.Finding{Path: "/app/old.bin", Layer: digest(upper), Signatures: []string{VIRUS_SIGNATURE}},
+			oci.Finding{Path: "/data/y.txt", Layer: digest(upper), Signatures: []string{VIRUS_SIGNATURE}},
+			oci.Finding{Path: "/etc/passwd", Layer: digest(lower), Signatures: []string{VIRUS_SIGNATURE}},
+		))
+	})
+
+	It("Should scan the layers of a docker save tarball", func() {
+		mock.Expect(INSTREAM, 1, RETURN_OK)
+		layer := NewTar(tarFile{name: "bin/sh", content: "sh"})
+		config, _ := json.Marshal(map[string]interface{}{"rootfs": map[string]interface{}{"diff_ids": []string{digest(layer)}}})
+		manifest, _ := json.Marshal([]map[string]interface{}{{
+			"Config":   "config.json",
+			"RepoTags": []string{"app:latest"},
+			"Layers":   []string{"0123/layer.tar"},
+		}})
+		filename := writeTar(
+			tarFile{name: "manifest.json", content: string(manifest)},
+			tarFile{name: "config.json", content: string(config)},
+			tarFile{name: "0123/layer.tar", content: string(layer)},
+		)
+		defer os.Remove(filename)
+
+		img, err := oci.Open(filename)
+		Expect(err).To(BeNil())
+		defer img.Close()
+		Expect(img.Tags).To(Equal([]string{"app:latest"}))
+		Expect(img.Layers).To(HaveLen(1))
+		Expect(img.Layers[0].Digest).To(Equal(digest(layer)))
+
+		report, err := img.Scan(context.Background(), client)
+		Expect(err).To(BeNil())
+		Expect(report.Scanned).To(Equal(1))
+		Expect(report.Failed()).To(BeFalse())
+	})
+
+	// nestedIndex returns an index which references the blob with the digest as an index
+	nestedIndex := func(digest string) string {
+		index, _ := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"manifests":     []map[string]string{{"mediaType": "application/vnd.oci.image.index.v1+json", "digest": digest}},
+		})
+		return string(index)
+	}
+
+	It("Should reject self-referencing indexes", func() {
+		self := "sha256:" + strings.Repeat("a", 64)
+		filename := writeTar(
+			tarFile{name: "index.json", content: nestedIndex(self)},
+			tarFile{name: "blobs/sha256/" + strings.Repeat("a", 64), content: nestedIndex(self)},
+		)
+		defer os.Remove(filename)
+		_, err := oci.Open(filename)
+		Expect(err).To(MatchError(oci.ErrInvalidImage))
+		Expect(err).To(MatchError(ContainSubstring("cycle")))
+	})
+
+	It("Should limit the depth of nested indexes", func() {
+		files := []tarFile{}
+		for i := 0; i < 10; i++ {
+			next := "sha256:" + strings.Repeat(strconv.Itoa(i), 64)
+			name := "index.json"
+			if i > 0 {
+				name = "blobs/sha256/" + strings.Repeat(strconv.Itoa(i-1), 64)
+			}
+			files = append(files, tarFile{name: name, content: nestedIndex(next)})
+		}
+		filename := writeTar(files...)
+		defer os.Remove(filename)
+		_, err := oci.Open(filename)
+		Expect(err).To(MatchError(oci.ErrInvalidImage))
+		Expect(err).To(MatchError(ContainSubstring("nested deeper")))
+	})
+
+	It("Should reject tarballs without manifest", func() {
+		filename := writeTar(tarFile{name: "file.txt", content: "text"})
+		defer os.Remove(filename)
+		_, err := oci.Open(filename)
+		Expect(err).To(MatchError(oci.ErrInvalidImage))
+	})
+})
@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/ron96G/clamav-facade/clamav"
+)
+
+var _ = Describe("Protocol", func() {
+	defer GinkgoRecover()
+
+	Describe("Parse scan reply", func() {
+		It("Should parse a clean reply", func() {
+			verdict, signatures, err := clamav.ParseScanReply("stream: OK\000")
+			Expect(err).To(BeNil())
+			Expect(verdict).To(Equal(clamav.VerdictClean))
+			Expect(signatures).To(BeEmpty())
+		})
+
+		It("Should parse all signatures of an infected reply", func() {
+			verdict, signatures, err := clamav.ParseScanReply("stream: Win.Test.EICAR_HDB-1 FOUND\000stream: Eicar-Signature FOUND\000")
+			Expect(err).To(BeNil())
+			Expect(verdict).To(Equal(clamav.VerdictInfected))
+			Expect(signatures).To(Equal([]string{"Win.Test.EICAR_HDB-1", "Eicar-Signature"}))
+		})
+
+		It("Should return a reply error", func() {
+			verdict, _, err := clamav.ParseScanReply("INSTREAM size limit exceeded. ERROR\000")
+			Expect(verdict).To(Equal(clamav.VerdictError))
+			Expect(err).To(MatchError(clamav.ErrSizeLimitExceeded))
+			replyErr := &clamav.ReplyError{}
+			Expect(err).To(BeAssignableToTypeOf(replyErr))
+		})
+
+		It("Should return an error for an unknown command", func() {
+			_, _, err := clamav.ParseScanReply("UNKNOWN COMMAND\n")
+			Expect(err).To(MatchError(clamav.ErrUnknownCommand))
+		})
+
+		It("Should return an error for an empty reply", func() {
+			_, _, err := clamav.ParseScanReply("")
+			Expect(err).To(MatchError(clamav.ErrEmptyReply))
+		})
+
+		It("Should return an error for a malformed reply", func() {
+			_, _, err := clamav.ParseScanReply("stream: Virus\n")
+			Expect(err).To(BeAssignableToTypeOf(&clamav.MalformedReplyError{}))
+		})
+	})
+
+	Describe("Parse stats", func() {
+		stats, err := clamav.ParseStats(MOCK_STATS)
+
+		It("Should parse all values", func() {
+			Expect(err).To(BeNil())
+			Expect(stats.Pools).To(Equal(1))
+			Expect(stats.State).To(Equal("VALID PRIMARY"))
+			Expect(stats.Threads).To(Equal(clamav.ThreadStats{Live: 1, Idle: 0, Max: 10, IdleTimeout: 30}))
+			Expect(stats.Queue).To(Equal(2))
+			Expect(stats.Memory.Heap).To(BeNil())
+			Expect(stats.Memory.Pools).To(Equal(1))
+			Expect(*stats.Memory.PoolsUsed).To(BeNumerically("~", 1280.741))
+			Expect(*stats.Memory.PoolsTotal).To(BeNumerically("~", 1280.788))
+		})
+
+		It("Should parse memory values", func() {
+			stats, err := clamav.ParseStats("POOLS: 1\nMEMSTATS: heap 9.082M mmap 0.000M used 6.902M free 2.184M releasable 0.129M pools 1 pools_used 565.979M pools_total 566.013M\nEND\000")
+			Expect(err).To(BeNil())
+			Expect(*stats.Memory.Heap).To(BeNumerically("~", 9.082))
+			Expect(*stats.Memory.Releasable).To(BeNumerically("~", 0.129))
+		})
+
+		It("Should fail for an incomplete reply", func() {
+			_, err := clamav.ParseStats("PONG")
+			Expect(err).To(BeAssignableToTypeOf(&clamav.MalformedReplyError{}))
+		})
+	})
+
+	Describe("Parse version", func() {
+		It("Should parse engine and database", func() {
+			version, err := clamav.ParseVersion(MOCK_VERSION + "\000")
+			Expect(err).To(BeNil())
+			Expect(version.Engine).To(Equal("1.0.1"))
+			Expect(version.Database).To(Equal(26820))
+			Expect(version.DatabaseTime).To(Equal(time.Date(2023, time.February, 28, 8, 24, 21, 0, time.UTC)))
+		})
+
+		It("Should parse the engine without database", func() {
+			version, err := clamav.ParseVersion("ClamAV 0.103.8")
+			Expect(err).To(BeNil())
+			Expect(version.Engine).To(Equal("0.103.8"))
+			Expect(version.Database).To(BeZero())
+		})
+
+		It("Should fail for an unknown reply", func() {
+			_, err := clamav.ParseVersion("PONG")
+			Expect(err).To(BeAssignableToTypeOf(&clamav.MalformedReplyError{}))
+		})
+	})
+})
@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/ron96G/clamav-facade/clamav"
+	"github.com/ron96G/clamav-facade/fetch"
+	"github.com/ron96G/clamav-facade/proxy"
+	"github.com/ron96G/go-common-utils/log"
+)
+
+var _ = Describe("Proxy", func() {
+	defer GinkgoRecover()
+
+	mock := NewMockServer("localhost", 33105)
+	if err := mock.Listen(); err != nil {
+		panic(err)
+	}
+	go mock.Run()
+
+	backend, _ := clamav.NewClamavClient("localhost", 33105, time.Second*10)
+	backend.SetMaxSize(4096)
+	server := proxy.NewServer("localhost:32126", backend, make(chan struct{}), log.New("proxy_logger"))
+	if err := server.Listen(); err != nil {
+		panic(err)
+	}
+	go server.Run()
+
+	// the client of the facade is used as a legacy clamd client
+	client, _ := clamav.NewClamavClient("localhost", 32126, time.Second*10)
+	client.SetMaxSize(1 << 20)
+
+	It("Should forward PING and VERSION", func() {
+		mock.Expect(PING, 1, RETURN_OK)
+		mock.Expect(VERSION, 1, RETURN_OK)
+		Expect(client.Ping(context.Background())).To(Succeed())
+		info, err := client.Version(context.Background())
+		Expect(err).To(BeNil())
+		Expect(info.Database).To(Equal(26820))
+	})
+
+	It("Should scan streams", func() {
+		mock.Expect(INSTREAM, 1, RETURN_VIRUS)
+		res, err := client.Scan(context.Background(), GenerateRandomReader(1024))
+		Expect(err).To(BeNil())
+		Expect(res.Infected()).To(BeTrue())
+		Expect(res.Signatures).To(Equal([]string{VIRUS_SIGNATURE}))
+
+		mock.Expect(INSTREAM, 1, RETURN_OK)
+		res, err = client.Scan(context.Background(), GenerateRandomReader(1024))
+		Expect(err).To(BeNil())
+		Expect(res.Clean()).To(BeTrue())
+	})
+
+	It("Should enforce the size limit", func() {
+		_, err := client.Scan(context.Background(), GenerateRandomReader(4097))
+		Expect(err).To(MatchError(ContainSubstring("size limit exceeded")))
+	})
+
+	It("Should reply to newline-terminated commands", func() {
+		mock.Expect(PING, 1, RETURN_OK)
+		conn, err := net.Dial("tcp", "localhost:32126")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		io.WriteString(conn, "nPING\n")
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		Expect(err).To(BeNil())
+		Expect(reply).To(Equal("PONG\n"))
+	})
+
+	It("Should reply to the commands of a session in order", func() {
+		mock.Expect(PING, 1, RETURN_OK)
+		mock.Expect(INSTREAM, 1, RETURN_OK)
+		conn, err := net.Dial("tcp", "localhost:32126")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		io.WriteString(conn, "zIDSESSION\000zPING\000zINSTREAM\000")
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, 5)
+		conn.Write(append(size, []byte("hello")...))
+		conn.Write([]byte{0, 0, 0, 0})
+		io.WriteString(conn, "zEND\000")
+
+		r := bufio.NewReader(conn)
+		reply, _ := r.ReadString('\000')
+		Expect(reply).To(Equal("1: PONG\000"))
+		reply, _ = r.ReadString('\000')
+		Expect(reply).To(Equal("2: stream: OK\000"))
+	})
+
+	It("Should reject sources which are not allowed", func() {
+		allowed, _ := fetch.ParseCIDRs([]string{"10.0.0.0/8"})
+		restricted := proxy.NewServer("localhost:32127", backend, make(chan struct{}), log.New("proxy_logger"))
+		restricted.AllowCIDRs = allowed
+		Expect(restricted.Listen()).To(Succeed())
+		go restricted.Run()
+
+		conn, err := net.Dial("tcp", "localhost:32127")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		io.WriteString(conn, "zPING\000")
+		r := bufio.NewReader(conn)
+		reply, err := r.ReadString('\000')
+		Expect(err).To(BeNil())
+		Expect(reply).To(Equal("PING: Access denied. ERROR\000"))
+		_, err = r.ReadString('\000')
+		Expect(err).To(Equal(io.EOF))
+	})
+})
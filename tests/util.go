@@ -7,8 +7,10 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	echo "github.com/labstack/echo/v4"
+	"github.com/ron96G/clamav-facade/fetch"
 )
 
 func NewMultipartFileRequest(method, path string, reader io.Reader) (*http.Request, error) {
@@ -31,6 +33,27 @@ func NewMultipartFileRequest(method, path string, reader io.Reader) (*http.Reque
 	return req, nil
 }
 
+// NewMultipartFilesRequest creates a request with all readers as files of the same field
+func NewMultipartFilesRequest(method, path, field string, filenames []string, readers []io.Reader) (*http.Request, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for i, reader := range readers {
+		part, err := writer.CreateFormFile(field, filenames[i])
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.Copy(part, reader); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	req := httptest.NewRequest(method, path, body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	return req, nil
+}
+
 func NewEchoMultipartFileContext(method, path string, reader io.Reader) (echo.Context, *httptest.ResponseRecorder, error) {
 	req, err := NewMultipartFileRequest(method, path, reader)
 	if err != nil {
@@ -51,3 +74,30 @@ func GenerateRandomReader(size int) io.Reader {
 	rand.Read(randomBytes)
 	return bytes.NewReader(randomBytes)
 }
+
+// NewFakeS3 returns a handler which serves objects like a S3-compatible service.
+// The signature of each request is verified with creds.
+func NewFakeS3(creds fetch.Credentials, objects map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		signed := r.Clone(r.Context())
+		signed.Header = http.Header{}
+		signed.Header.Set("X-Amz-Content-Sha256", r.Header.Get("X-Amz-Content-Sha256"))
+		fetch.SignV4(signed, creds, "us-east-1", "s3", date)
+		if signed.Header.Get("Authorization") != r.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		content, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, content)
+	})
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/ron96G/clamav-facade/fetch"
+	"github.com/ron96G/clamav-facade/webhook"
+)
+
+var _ = Describe("Webhook", func() {
+	secret := []byte("secret")
+
+	newSender := func(client *http.Client) *webhook.Sender {
+		sender := webhook.NewSender(client, secret)
+		sender.Backoff = 10 * time.Millisecond
+		sender.MaxAttempts = 3
+		return sender
+	}
+
+	It("Should sign the payload", func() {
+		var signature, event string
+		var timestamp int64
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			signature = r.Header.Get(webhook.SignatureHeader)
+			event = r.Header.Get(webhook.EventHeader)
+			timestamp, _ = strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+			body, _ = io.ReadAll(r.Body)
+		}))
+		defer server.Close()
+
+		err := newSender(nil).Send(context.Background(), server.URL, "scan.completed", map[string]string{"status": "success"})
+		Expect(err).To(BeNil())
+		Expect(string(body)).To(Equal(`{"status":"success"}`))
+		Expect(event).To(Equal("scan.completed"))
+		Expect(webhook.Verify(secret, timestamp, body, signature, time.Minute)).To(BeTrue())
+		Expect(webhook.Verify([]byte("wrong"), timestamp, body, signature, time.Minute)).To(BeFalse())
+		Expect(webhook.Verify(secret, timestamp+1, body, signature, time.Minute)).To(BeFalse())
+	})
+
+	It("Should reject replayed deliveries", func() {
+		timestamp := time.Now().Add(-time.Hour).Unix()
+		body := []byte(`{"status":"success"}`)
+		signature := webhook.Sign(secret, timestamp, body)
+		Expect(webhook.Verify(secret, timestamp, body, signature, 2*time.Hour)).To(BeTrue())
+		Expect(webhook.Verify(secret, timestamp, body, signature, time.Minute)).To(BeFalse())
+	})
+
+	It("Should retry temporary failures", func() {
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&attempts, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer server.Close()
+
+		Expect(newSender(nil).Send(context.Background(), server.URL, "scan.completed", nil)).To(Succeed())
+		Expect(atomic.LoadInt32(&attempts)).To(Equal(int32(3)))
+	})
+
+	It("Should not retry permanent failures", func() {
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		err := newSender(nil).Send(context.Background(), server.URL, "scan.completed", nil)
+		statusErr := &webhook.StatusError{}
+		Expect(errors.As(err, &statusErr)).To(BeTrue())
+		Expect(statusErr.StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(atomic.LoadInt32(&attempts)).To(Equal(int32(1)))
+	})
+
+	It("Should not deliver to internal addresses", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		err := newSender((&fetch.Guard{}).Client(time.Second)).Send(context.Background(), server.URL, "scan.completed", nil)
+		Expect(errors.Is(err, fetch.ErrForbidden)).To(BeTrue())
+	})
+})
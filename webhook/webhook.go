@@ -0,0 +1,145 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ron96G/clamav-facade/fetch"
+)
+
+const (
+	// SignatureHeader contains the HMAC-SHA256 of '<timestamp>.<body>' in the form 'sha256=<hex>'
+	SignatureHeader = "X-Signature-256"
+	// TimestampHeader contains the unix time of the attempt. It is signed to prevent replays.
+	TimestampHeader = "X-Webhook-Timestamp"
+	// EventHeader contains the event of the delivery
+	EventHeader = "X-Webhook-Event"
+	// DeliveryHeader contains the attempt of the delivery, starting with 1
+	DeliveryHeader = "X-Webhook-Attempt"
+)
+
+// StatusError is returned if the receiver does not respond with a 2xx status code
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook %s returned status code %d", e.URL, e.StatusCode)
+}
+
+// temporary returns whether the delivery can succeed if it is retried
+func (e *StatusError) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Sender delivers json payloads to webhooks. Failed deliveries are retried with exponential backoff.
+type Sender struct {
+	Client *http.Client
+	// Secret is the key of the signature. If it is empty, deliveries are not signed.
+	Secret []byte
+	// MaxAttempts is the maximum number of attempts of a delivery
+	MaxAttempts int
+	// Backoff is the duration before the first retry. It is doubled for every retry.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func NewSender(client *http.Client, secret []byte) *Sender {
+	return &Sender{
+		Client:      client,
+		Secret:      secret,
+		MaxAttempts: 5,
+		Backoff:     time.Second,
+		MaxBackoff:  time.Minute,
+	}
+}
+
+// Sign returns the value of the signature header of body sent at timestamp
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	fmt.Fprintf(h, "%d.", timestamp)
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify returns whether signature is the signature of body sent at timestamp
+// and the timestamp is not further off than tolerance
+func Verify(secret []byte, timestamp int64, body []byte, signature string, tolerance time.Duration) bool {
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Send posts payload as json to url until it is accepted, a permanent error occurs or all attempts failed
+func (s *Sender) Send(ctx context.Context, url, event string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	backoff := s.Backoff
+	for attempt := 1; ; attempt++ {
+		err = s.post(ctx, url, event, attempt, body)
+		if err == nil || attempt >= s.MaxAttempts || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if s.MaxBackoff > 0 && backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+func (s *Sender) post(ctx context.Context, url, event string, attempt int, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, fmt.Sprint(attempt))
+	if len(s.Secret) > 0 {
+		timestamp := time.Now().Unix()
+		req.Header.Set(TimestampHeader, fmt.Sprint(timestamp))
+		req.Header.Set(SignatureHeader, Sign(s.Secret, timestamp, body))
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{URL: url, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.temporary()
+	}
+	return !errors.Is(err, fetch.ErrForbidden) && !errors.Is(err, context.Canceled)
+}